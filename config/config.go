@@ -1,6 +1,10 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"image/color"
 	"io/ioutil"
@@ -8,12 +12,12 @@ import (
 	"os/user"
 	"path"
 	"runtime"
+	"sync"
 	"time"
 
 	"gioui.org/app"
 	"gioui.org/layout"
 	"gioui.org/widget/material"
-	"github.com/google/uuid"
 )
 
 const (
@@ -21,6 +25,8 @@ const (
 	updatePerSecond = time.Second / FPS
 )
 
+// Port is the default server port and the port of the discovery
+// beacon.
 const (
 	Port     = 9182
 	ConfFile = "config"
@@ -56,12 +62,67 @@ const (
 
 	ICOnline  = '\uf836'
 	ICOffline = '\uf837'
+
+	ICPair = '\uf0c1'
+
+	ICFavorite   = '\uf005'
+	ICUnfavorite = '\uf006'
+)
+
+// Default limits for the fields received from peers, used when the
+// config doesn't set them.
+const (
+	DefaultMaxID       = 256
+	DefaultMaxName     = 1024
+	DefaultMaxMSG      = 1 << 20
+	DefaultMaxFiles    = 100000
+	DefaultMaxFileName = 4096
+	DefaultMaxBufSize  = 16 << 20
+	DefaultMaxManifest = 64 << 20
+)
+
+// DefaultBufSize is the biggest chunk sent by default, configs with
+// less than MinBufSize were saved when it was 1 KiB and get it.
+const (
+	DefaultBufSize = 1 << 20
+	MinBufSize     = 64 << 10
+)
+
+// Default network timeouts in ms: to connect, for an answer and for
+// progress while transferring data.
+const (
+	DefaultConnectTimeout = 5000
+	DefaultIdleTimeout    = 30000
+	DefaultStallTimeout   = 20000
+)
+
+// DefaultStreams is how many connections a transfer may use at once.
+const DefaultStreams = 4
+
+// What unpaired devices are allowed to send.
+const (
+	UnpairedMessages = uint64(iota)
+	UnpairedAll
+	UnpairedNothing
+)
+
+// How file data is compressed on the wire, both peers have to agree.
+const (
+	CompressNone = uint64(iota)
+	CompressDeflate
 )
 
+type TrustedDevice struct {
+	ID     string
+	Name   string
+	Paired time.Time
+}
+
 type Config struct {
 	th *material.Theme
 
 	UUID string
+	Key  ed25519.PrivateKey
 
 	C_Name               string
 	C_InboxDir           string
@@ -69,6 +130,30 @@ type Config struct {
 	C_ConnectionsTimeout uint64
 	C_BufSize            uint64
 	C_AnimTime           uint64
+	C_Unpaired           uint64
+	C_Compress           uint64
+
+	C_MaxID       uint64
+	C_MaxName     uint64
+	C_MaxMSG      uint64
+	C_MaxFiles    uint64
+	C_MaxFileName uint64
+	C_MaxBufSize  uint64
+	C_MaxManifest uint64
+
+	C_ConnectTimeout uint64
+	C_IdleTimeout    uint64
+	C_StallTimeout   uint64
+	C_Streams        uint64
+
+	C_ListenAddr      string
+	C_ListenInterface string
+	C_ListenPort      uint64
+
+	// IPs or hostnames, with an optional port, probed on start
+	C_StaticPeers []string
+
+	Trusted []*TrustedDevice
 
 	ScreenColor color.NRGBA
 	Shadow      color.NRGBA
@@ -89,6 +174,7 @@ type Config struct {
 	closeDialog func()
 
 	old time.Time
+	mu  sync.Mutex
 }
 
 func NewConfig(th *material.Theme) *Config {
@@ -98,8 +184,11 @@ func NewConfig(th *material.Theme) *Config {
 	if !conf.Load() {
 		conf.Reset()
 	}
-	if conf.UUID == "" {
-		conf.UUID = uuid.NewString()
+	if len(conf.Key) != ed25519.PrivateKeySize {
+		_, conf.Key, _ = ed25519.GenerateKey(rand.Reader)
+	}
+	if id := DeviceID(conf.PublicKey()); conf.UUID != id {
+		conf.UUID = id
 		conf.Save()
 	}
 	conf.UpdateColors()
@@ -111,8 +200,24 @@ func (p *Config) Reset() {
 	p.C_InboxDir = path.Join(p.AppDir(), "files")
 	p.C_Connections = 20
 	p.C_ConnectionsTimeout = 500
-	p.C_BufSize = 1024
+	p.C_BufSize = DefaultBufSize
 	p.C_AnimTime = 300
+	p.C_Unpaired = UnpairedMessages
+	p.C_Compress = CompressDeflate
+	p.C_MaxID = DefaultMaxID
+	p.C_MaxName = DefaultMaxName
+	p.C_MaxMSG = DefaultMaxMSG
+	p.C_MaxFiles = DefaultMaxFiles
+	p.C_MaxFileName = DefaultMaxFileName
+	p.C_MaxBufSize = DefaultMaxBufSize
+	p.C_MaxManifest = DefaultMaxManifest
+	p.C_ConnectTimeout = DefaultConnectTimeout
+	p.C_IdleTimeout = DefaultIdleTimeout
+	p.C_StallTimeout = DefaultStallTimeout
+	p.C_Streams = DefaultStreams
+	p.C_ListenAddr = ""
+	p.C_ListenInterface = ""
+	p.C_ListenPort = Port
 	os.MkdirAll(p.C_InboxDir, 0777)
 
 	p.ScreenColor = color.NRGBA{230, 230, 230, 255}
@@ -144,12 +249,34 @@ func (p *Config) Load() bool {
 }
 
 func (p *Config) Save() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	buf, err := json.Marshal(p)
 	if err != nil {
 		return err
 	}
+	// It holds the private key, configs saved before kept 0777
 	filePath := path.Join(p.AppDir(), ConfFile)
-	return ioutil.WriteFile(filePath, buf, 0777)
+	err = ioutil.WriteFile(filePath, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(filePath, 0600)
+}
+
+// DeviceID derives the device ID from its public key, so nobody can claim
+// an ID without holding the matching private key.
+func DeviceID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:16])
+}
+
+func (p *Config) PublicKey() ed25519.PublicKey {
+	return p.Key.Public().(ed25519.PublicKey)
+}
+
+func (p *Config) Sign(msg []byte) []byte {
+	return ed25519.Sign(p.Key, msg)
 }
 
 func (p *Config) Name() string {
@@ -168,10 +295,101 @@ func (p *Config) Timeout() uint64 {
 	return p.C_ConnectionsTimeout
 }
 
+func (p *Config) ConnectTimeout() time.Duration {
+	return time.Duration(limit(p.C_ConnectTimeout, DefaultConnectTimeout)) * time.Millisecond
+}
+
+func (p *Config) IdleTimeout() time.Duration {
+	return time.Duration(limit(p.C_IdleTimeout, DefaultIdleTimeout)) * time.Millisecond
+}
+
+func (p *Config) StallTimeout() time.Duration {
+	return time.Duration(limit(p.C_StallTimeout, DefaultStallTimeout)) * time.Millisecond
+}
+
+// ListenAddr and ListenInterface restrict the addresses the server
+// binds, empty binds all of them.
+func (p *Config) ListenAddr() string {
+	return p.C_ListenAddr
+}
+
+func (p *Config) ListenInterface() string {
+	return p.C_ListenInterface
+}
+
+// ListenPort is the port tried first, the server falls back to another
+// one when it's taken.
+func (p *Config) ListenPort() uint64 {
+	return limit(p.C_ListenPort, Port)
+}
+
+func (p *Config) StaticPeers() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.C_StaticPeers...)
+}
+
+// Streams is how many connections a transfer may use at once, the
+// peers settle on the smaller of their limits.
+func (p *Config) Streams() uint64 {
+	return limit(p.C_Streams, DefaultStreams)
+}
+
+// BufSize is the biggest chunk sent, the sender adapts the size to the
+// link below it.
 func (p *Config) BufSize() uint64 {
+	if p.C_BufSize < MinBufSize {
+		return DefaultBufSize
+	}
 	return p.C_BufSize
 }
 
+func (p *Config) Unpaired() uint64 {
+	return p.C_Unpaired
+}
+
+// Compress is the compression offered for files sent and accepted for
+// files received.
+func (p *Config) Compress() uint64 {
+	return p.C_Compress
+}
+
+func limit(value, def uint64) uint64 {
+	if value == 0 {
+		return def
+	}
+	return value
+}
+
+func (p *Config) MaxID() uint64 {
+	return limit(p.C_MaxID, DefaultMaxID)
+}
+
+func (p *Config) MaxName() uint64 {
+	return limit(p.C_MaxName, DefaultMaxName)
+}
+
+func (p *Config) MaxMSG() uint64 {
+	return limit(p.C_MaxMSG, DefaultMaxMSG)
+}
+
+func (p *Config) MaxFiles() uint64 {
+	return limit(p.C_MaxFiles, DefaultMaxFiles)
+}
+
+func (p *Config) MaxFileName() uint64 {
+	return limit(p.C_MaxFileName, DefaultMaxFileName)
+}
+
+func (p *Config) MaxBufSize() uint64 {
+	return limit(p.C_MaxBufSize, DefaultMaxBufSize)
+}
+
+// MaxManifest bounds the names of all the files of a transfer together.
+func (p *Config) MaxManifest() uint64 {
+	return limit(p.C_MaxManifest, DefaultMaxManifest)
+}
+
 func (p *Config) AnimTime() time.Duration {
 	if p.C_AnimTime == 0 {
 		return time.Millisecond
@@ -199,6 +417,41 @@ func (p *Config) SetTimeout(n uint64) error {
 	return p.Save()
 }
 
+func (p *Config) SetConnectTimeout(ms uint64) error {
+	p.C_ConnectTimeout = ms
+	return p.Save()
+}
+
+func (p *Config) SetIdleTimeout(ms uint64) error {
+	p.C_IdleTimeout = ms
+	return p.Save()
+}
+
+func (p *Config) SetStallTimeout(ms uint64) error {
+	p.C_StallTimeout = ms
+	return p.Save()
+}
+
+func (p *Config) SetListenAddr(addr string) error {
+	p.C_ListenAddr = addr
+	return p.Save()
+}
+
+func (p *Config) SetListenInterface(name string) error {
+	p.C_ListenInterface = name
+	return p.Save()
+}
+
+func (p *Config) SetListenPort(port uint64) error {
+	p.C_ListenPort = port
+	return p.Save()
+}
+
+func (p *Config) SetStreams(n uint64) error {
+	p.C_Streams = n
+	return p.Save()
+}
+
 func (p *Config) SetBufSize(n uint64) error {
 	p.C_BufSize = n
 	return p.Save()
@@ -209,6 +462,95 @@ func (p *Config) SetAnimTime(ms uint64) error {
 	return p.Save()
 }
 
+func (p *Config) SetUnpaired(policy uint64) error {
+	p.C_Unpaired = policy
+	return p.Save()
+}
+
+func (p *Config) SetCompress(mode uint64) error {
+	p.C_Compress = mode
+	return p.Save()
+}
+
+func (p *Config) SetMaxID(n uint64) error {
+	p.C_MaxID = n
+	return p.Save()
+}
+
+func (p *Config) SetMaxName(n uint64) error {
+	p.C_MaxName = n
+	return p.Save()
+}
+
+func (p *Config) SetMaxMSG(n uint64) error {
+	p.C_MaxMSG = n
+	return p.Save()
+}
+
+func (p *Config) SetMaxFiles(n uint64) error {
+	p.C_MaxFiles = n
+	return p.Save()
+}
+
+func (p *Config) SetMaxFileName(n uint64) error {
+	p.C_MaxFileName = n
+	return p.Save()
+}
+
+func (p *Config) SetMaxBufSize(n uint64) error {
+	p.C_MaxBufSize = n
+	return p.Save()
+}
+
+func (p *Config) SetMaxManifest(n uint64) error {
+	p.C_MaxManifest = n
+	return p.Save()
+}
+
+// Trusted devices ##############################
+func (p *Config) TrustedDevices() []*TrustedDevice {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*TrustedDevice{}, p.Trusted...)
+}
+
+func (p *Config) IsTrusted(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range p.Trusted {
+		if t.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Config) Trust(dev *TrustedDevice) error {
+	p.mu.Lock()
+	trusted := []*TrustedDevice{dev}
+	for _, t := range p.Trusted {
+		if t.ID != dev.ID {
+			trusted = append(trusted, t)
+		}
+	}
+	p.Trusted = trusted
+	p.mu.Unlock()
+	return p.Save()
+}
+
+func (p *Config) Untrust(id string) error {
+	p.mu.Lock()
+	trusted := []*TrustedDevice{}
+	for _, t := range p.Trusted {
+		if t.ID != id {
+			trusted = append(trusted, t)
+		}
+	}
+	p.Trusted = trusted
+	p.mu.Unlock()
+	return p.Save()
+}
+
 func (p *Config) OS() string {
 	return runtime.GOOS
 }
@@ -238,6 +580,10 @@ func (p *Config) GetName() string {
 }
 
 func (p *Config) UpdateColors() {
+	// The benchmark has no window
+	if p.th == nil {
+		return
+	}
 	p.th.Bg = p.BGColor
 	p.th.Fg = p.FGColor
 	p.th.ContrastBg = p.BGPrimaryColor
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import "syscall"
+
+// FreeSpace returns the bytes available to the user on the volume of dir.
+func FreeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(dir, &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
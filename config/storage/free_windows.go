@@ -0,0 +1,14 @@
+package storage
+
+import "golang.org/x/sys/windows"
+
+// FreeSpace returns the bytes available to the user on the volume of dir.
+func FreeSpace(dir string) (uint64, error) {
+	name, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free, total, totalFree uint64
+	err = windows.GetDiskFreeSpaceEx(name, &free, &total, &totalFree)
+	return free, err
+}
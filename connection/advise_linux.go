@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package connection
+
+import (
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// adviseSequential asks the kernel for a bigger read-ahead on a file
+// that is read from start to end.
+func adviseSequential(f *os.File) {
+	unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_SEQUENTIAL)
+}
+
+// sendFile writes size bytes of f from off to a plain TCP connection
+// with sendfile, the data never goes through user space. Transfers go
+// through TLS and can't be zero-copy, only the benchmark uses it.
+func sendFile(conn *net.TCPConn, f *os.File, off int64, size uint64) error {
+	raw, e := conn.SyscallConn()
+	if e != nil {
+		return e
+	}
+	adviseSequential(f)
+	src := int(f.Fd())
+	for size > 0 {
+		chunk := size
+		if chunk > 1<<30 {
+			chunk = 1 << 30
+		}
+		var n int
+		var se error
+		e = raw.Write(func(fd uintptr) bool {
+			n, se = unix.Sendfile(int(fd), src, &off, int(chunk))
+			return se != unix.EAGAIN
+		})
+		if e != nil {
+			return e
+		}
+		if se != nil {
+			return os.NewSyscallError("sendfile", se)
+		}
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		size -= uint64(n)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package connection
+
+import (
+	"io"
+	"net"
+	"os"
+)
+
+func adviseSequential(f *os.File) {}
+
+// sendFile writes size bytes of f from off to a plain TCP connection,
+// the runtime uses sendfile for a limited *os.File where the system has
+// it. Transfers go through TLS and can't be zero-copy, only the
+// benchmark uses it.
+func sendFile(conn *net.TCPConn, f *os.File, off int64, size uint64) error {
+	_, e := f.Seek(off, io.SeekStart)
+	if e != nil {
+		return e
+	}
+	n, e := conn.ReadFrom(&io.LimitedReader{R: f, N: int64(size)})
+	if e == nil && uint64(n) < size {
+		e = io.ErrUnexpectedEOF
+	}
+	return e
+}
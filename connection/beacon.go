@@ -0,0 +1,494 @@
+package connection
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/julioguillermo/jg_sender/config"
+)
+
+// Beacon packets are sent over UDP to the same port as the server.
+const (
+	BEACON_ANNOUNCE = byte(iota)
+	BEACON_PROBE
+	BEACON_GOODBYE
+)
+
+const (
+	BeaconInterval = 5 * time.Second
+	// BeaconMaxAge rejects old announcements and peers whose clock is
+	// too far off, the newer ones replace them within it.
+	BeaconMaxAge = 30 * time.Second
+	// BeaconMaxSize fits in a single datagram on any LAN, probes are
+	// padded to it so no answer is larger than the probe.
+	BeaconMaxSize = 1400
+	// BeaconMaxAddrs caps the addresses an announcement signs.
+	BeaconMaxAddrs = 16
+	// BeaconReplyInterval is how often an address gets an answer to
+	// its probes.
+	BeaconReplyInterval = time.Second
+)
+
+var ErrStaleBeacon = errors.New("stale beacon")
+
+// Announcement is a signed beacon. Addrs are the addresses the device
+// announces from, the source of the datagram has to be one of them.
+type Announcement struct {
+	ID    string
+	Key   []byte
+	Name  string
+	OS    string
+	Port  uint16
+	Addrs []netip.Addr
+	Time  time.Time
+	Sig   []byte
+}
+
+func (p *Announcement) message() []byte {
+	fields := []string{p.ID, p.Name, p.OS, fmt.Sprint(p.Port)}
+	for _, a := range p.Addrs {
+		fields = append(fields, a.String())
+	}
+	return signedMessage(SignBeacon, IntToBytes(uint64(p.Time.UnixNano())), fields...)
+}
+
+// goodbye is what a goodbye signs, it only has the ID and the time.
+func (p *Announcement) goodbye() []byte {
+	return signedMessage(SignGoodbye, IntToBytes(uint64(p.Time.UnixNano())), p.ID)
+}
+
+// from tells if the announcement was signed for ip.
+func (p *Announcement) from(ip netip.Addr) bool {
+	ip = ip.Unmap().WithZone("")
+	for _, a := range p.Addrs {
+		if a == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// IPv6 has no broadcast, the beacon goes to every node of the link.
+var allNodes = netip.MustParseAddr("ff02::1")
+
+// Beacon announces this device on the LAN and fills Records with the
+// announcements of the others. IPv4 uses broadcast. Peers dial the
+// source address, so only the IP versions the server listens on are
+// used, the other conn is nil.
+type Beacon struct {
+	ctx   context.Context
+	conf  *config.Config
+	port  uint16
+	conn  *net.UDPConn
+	conn6 *net.UDPConn
+
+	// The time of the last beacon taken from each device, and when
+	// each address got an answer to a probe
+	mu      sync.Mutex
+	last    map[string]time.Time
+	replied map[netip.Addr]time.Time
+}
+
+// StartBeacon listens for beacons on the default port until ctx is
+// done, port is the one the server announces.
+func StartBeacon(ctx context.Context, conf *config.Config, port uint16) (*Beacon, error) {
+	beacon := &Beacon{
+		ctx:     ctx,
+		conf:    conf,
+		port:    port,
+		last:    map[string]time.Time{},
+		replied: map[netip.Addr]time.Time{},
+	}
+	host, _ := listenHost(conf)
+	listen, _ := netip.ParseAddr(host)
+
+	var err error
+	if !listen.IsValid() || listen.Is4() {
+		beacon.conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: config.Port})
+		if err != nil {
+			log.Println("beacon", err)
+		}
+	}
+	if !listen.IsValid() || listen.Is6() {
+		var e error
+		beacon.conn6, e = net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified, Port: config.Port})
+		if e != nil {
+			log.Println("beacon", e)
+			err = e
+		}
+	}
+	if beacon.conn == nil && beacon.conn6 == nil {
+		return nil, err
+	}
+
+	for _, conn := range []*net.UDPConn{beacon.conn, beacon.conn6} {
+		if conn == nil {
+			continue
+		}
+		conn := conn
+		go func() {
+			<-ctx.Done()
+			conn.Close()
+		}()
+		go beacon.listen(conn)
+	}
+	go beacon.announceLoop()
+	return beacon, nil
+}
+
+// probePacket is padded to BeaconMaxSize, the announcement answering
+// it is never larger.
+func probePacket(id string) []byte {
+	var pkt bytes.Buffer
+	codec := NewCodec(&pkt)
+	codec.WriteAll(CTL)
+	codec.WriteByte(BEACON_PROBE)
+	codec.WriteString(id)
+	if pkt.Len() < BeaconMaxSize {
+		pkt.Write(make([]byte, BeaconMaxSize-pkt.Len()))
+	}
+	return pkt.Bytes()
+}
+
+// Goodbye tells the LAN this device is shutting down.
+func (p *Beacon) Goodbye() error {
+	ann := &Announcement{
+		ID:   p.conf.UUID,
+		Time: time.Now(),
+	}
+	ann.Sig = p.conf.Sign(ann.goodbye())
+
+	var pkt bytes.Buffer
+	codec := NewCodec(&pkt)
+	codec.WriteAll(CTL)
+	codec.WriteByte(BEACON_GOODBYE)
+	codec.WriteString(ann.ID)
+	codec.WriteFrame(p.conf.PublicKey())
+	codec.WriteUint64(uint64(ann.Time.UnixNano()))
+	codec.WriteFrame(ann.Sig)
+	return p.broadcast(pkt.Bytes())
+}
+
+// Probe asks every device on the LAN to announce itself now.
+func (p *Beacon) Probe() error {
+	return p.broadcast(probePacket(p.conf.UUID))
+}
+
+// ProbeLink sends a probe to every node of the links without a beacon
+// socket, the answers fill the IPv6 neighbor cache.
+func ProbeLink(id string) error {
+	conn, err := net.ListenUDP("udp6", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return sendLink(conn, probePacket(id))
+}
+
+// sendLink sends pkt to every node of each link, it only fails when no
+// link could be reached.
+func sendLink(conn *net.UDPConn, pkt []byte) error {
+	err := ErrNoDiscovery
+	sent := false
+	for _, ifi := range linkInterfaces() {
+		to := netip.AddrPortFrom(allNodes.WithZone(ifi.Name), uint16(config.Port))
+		_, e := conn.WriteToUDPAddrPort(pkt, to)
+		if e != nil {
+			err = e
+		} else {
+			sent = true
+		}
+	}
+	if sent {
+		return nil
+	}
+	return err
+}
+
+func (p *Beacon) announceLoop() {
+	ticker := time.NewTicker(BeaconInterval)
+	defer ticker.Stop()
+	for {
+		e := p.broadcast(p.announcement())
+		if e != nil {
+			log.Println("beacon", e)
+		}
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Beacon) announcement() []byte {
+	ann := &Announcement{
+		ID:    p.conf.UUID,
+		Key:   p.conf.PublicKey(),
+		Name:  p.conf.Name(),
+		OS:    p.conf.OS(),
+		Port:  p.port,
+		Addrs: advertised(p.conf),
+		Time:  time.Now(),
+	}
+	if len(ann.Addrs) > BeaconMaxAddrs {
+		ann.Addrs = ann.Addrs[:BeaconMaxAddrs]
+	}
+	ann.Sig = p.conf.Sign(ann.message())
+
+	var pkt bytes.Buffer
+	codec := NewCodec(&pkt)
+	codec.WriteAll(CTL)
+	codec.WriteByte(BEACON_ANNOUNCE)
+	codec.WriteString(ann.ID)
+	codec.WriteFrame(ann.Key)
+	codec.WriteString(ann.Name)
+	codec.WriteString(ann.OS)
+	codec.WriteUint64(uint64(ann.Port))
+	codec.WriteUint64(uint64(len(ann.Addrs)))
+	for _, a := range ann.Addrs {
+		codec.WriteFrame(a.AsSlice())
+	}
+	codec.WriteUint64(uint64(ann.Time.UnixNano()))
+	codec.WriteFrame(ann.Sig)
+	return pkt.Bytes()
+}
+
+// broadcast sends pkt to every local subnet, it only fails when no
+// subnet could be reached.
+func (p *Beacon) broadcast(pkt []byte) error {
+	targets := []netip.Addr{netip.AddrFrom4([4]byte{255, 255, 255, 255})}
+	for _, sn := range GetIPS() {
+		ip, ok := Broadcast(sn)
+		if ok {
+			targets = append(targets, ip)
+		}
+	}
+	err := ErrNoDiscovery
+	sent := false
+	for _, ip := range targets {
+		if p.conn == nil {
+			break
+		}
+		_, e := p.conn.WriteToUDPAddrPort(pkt, netip.AddrPortFrom(ip, uint16(config.Port)))
+		if e != nil {
+			err = e
+		} else {
+			sent = true
+		}
+	}
+	if p.conn6 != nil {
+		e := sendLink(p.conn6, pkt)
+		if e != nil {
+			err = e
+		} else {
+			sent = true
+		}
+	}
+	if sent {
+		return nil
+	}
+	return err
+}
+
+func (p *Beacon) listen(conn *net.UDPConn) {
+	buf := make([]byte, BeaconMaxSize)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if p.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		p.handle(conn, buf[:n], from)
+	}
+}
+
+func (p *Beacon) handle(conn *net.UDPConn, pkt []byte, from netip.AddrPort) {
+	kind, id, ann, e := ParseBeacon(pkt, NewLimits(p.conf))
+	if e != nil {
+		if errors.Is(e, ErrProtocol) || e == ErrSpoofed {
+			log.Println(from, e)
+		}
+		return
+	}
+	if id == p.conf.UUID {
+		return
+	}
+	switch kind {
+	case BEACON_PROBE:
+		reply := p.announcement()
+		if len(reply) <= len(pkt) && p.mayReply(from.Addr()) {
+			conn.WriteToUDPAddrPort(reply, from)
+		}
+	case BEACON_ANNOUNCE:
+		if !p.fresh(ann) {
+			return
+		}
+		if !ann.from(from.Addr()) {
+			log.Println(from, "announces", ann.ID, "from an address it didn't sign")
+			return
+		}
+		addr := netip.AddrPortFrom(from.Addr().Unmap(), ann.Port)
+		announced(p.ctx, p.conf, &Device{
+			ID:   ann.ID,
+			Addr: &addr,
+			Name: ann.Name,
+			OS:   ann.OS,
+		})
+	case BEACON_GOODBYE:
+		if p.fresh(ann) {
+			Records.SetOffline(ann.ID)
+		}
+	}
+}
+
+// fresh takes the time of ann, it has to be later than the one of the
+// last beacon of the device. Older times are rejected by their age.
+func (p *Beacon) fresh(ann *Announcement) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !ann.Time.After(p.last[ann.ID]) {
+		return false
+	}
+	p.last[ann.ID] = ann.Time
+	for id, t := range p.last {
+		if time.Since(t) > BeaconMaxAge {
+			delete(p.last, id)
+		}
+	}
+	return true
+}
+
+// mayReply tells if addr can get an answer to a probe now.
+func (p *Beacon) mayReply(addr netip.Addr) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if now.Sub(p.replied[addr]) < BeaconReplyInterval {
+		return false
+	}
+	p.replied[addr] = now
+	for a, t := range p.replied {
+		if now.Sub(t) >= BeaconReplyInterval {
+			delete(p.replied, a)
+		}
+	}
+	return true
+}
+
+// ParseBeacon reads a beacon packet, announcements and goodbyes are
+// verified.
+func ParseBeacon(pkt []byte, limits *Limits) (kind byte, id string, ann *Announcement, e error) {
+	if len(pkt) > BeaconMaxSize {
+		return 0, "", nil, overLimit("beacon", uint64(len(pkt)), BeaconMaxSize)
+	}
+	codec := NewCodec(bytes.NewBuffer(pkt))
+	magic := make([]byte, len(CTL))
+	if codec.ReadFull(magic) != nil || !CheckCTL(magic) {
+		return 0, "", nil, fmt.Errorf("%w: not a beacon", ErrProtocol)
+	}
+	kind, e = codec.ReadByte()
+	if e != nil {
+		return
+	}
+	id, e = codec.ReadString(limits.ID)
+	if e != nil {
+		return
+	}
+	switch kind {
+	case BEACON_PROBE:
+		return
+	case BEACON_ANNOUNCE, BEACON_GOODBYE:
+	default:
+		return kind, id, nil, fmt.Errorf("%w: beacon kind %d", ErrProtocol, kind)
+	}
+
+	ann = &Announcement{ID: id}
+	ann.Key, e = codec.ReadFrame(MaxKey)
+	if e != nil {
+		return
+	}
+	if kind == BEACON_GOODBYE {
+		return parseGoodbye(codec, ann)
+	}
+	ann.Name, e = codec.ReadString(limits.Name)
+	if e != nil {
+		return
+	}
+	ann.OS, e = codec.ReadString(MaxOS)
+	if e != nil {
+		return
+	}
+	ann.Port, e = readPort(codec)
+	if e != nil {
+		return
+	}
+	count, e := codec.ReadUint64()
+	if e != nil {
+		return
+	}
+	if count > BeaconMaxAddrs {
+		return kind, id, nil, overLimit("addresses", count, BeaconMaxAddrs)
+	}
+	for i := uint64(0); i < count; i++ {
+		var raw []byte
+		raw, e = codec.ReadFrame(16)
+		if e != nil {
+			return
+		}
+		a, ok := netip.AddrFromSlice(raw)
+		if !ok {
+			return kind, id, nil, fmt.Errorf("%w: address of %d bytes", ErrProtocol, len(raw))
+		}
+		ann.Addrs = append(ann.Addrs, a)
+	}
+	stamp, e := codec.ReadUint64()
+	if e != nil {
+		return
+	}
+	ann.Time = time.Unix(0, int64(stamp))
+	ann.Sig, e = codec.ReadFrame(MaxSig)
+	if e != nil {
+		return
+	}
+
+	age := time.Since(ann.Time)
+	if age > BeaconMaxAge || age < -BeaconMaxAge {
+		return kind, id, nil, ErrStaleBeacon
+	}
+	e = verifySigned(ann.ID, ann.Key, ann.Sig, ann.message())
+	if e != nil {
+		return kind, id, nil, e
+	}
+	return kind, id, ann, nil
+}
+
+func parseGoodbye(codec *Codec, ann *Announcement) (byte, string, *Announcement, error) {
+	stamp, e := codec.ReadUint64()
+	if e != nil {
+		return BEACON_GOODBYE, ann.ID, nil, e
+	}
+	ann.Time = time.Unix(0, int64(stamp))
+	ann.Sig, e = codec.ReadFrame(MaxSig)
+	if e != nil {
+		return BEACON_GOODBYE, ann.ID, nil, e
+	}
+	age := time.Since(ann.Time)
+	if age > BeaconMaxAge || age < -BeaconMaxAge {
+		return BEACON_GOODBYE, ann.ID, nil, ErrStaleBeacon
+	}
+	e = verifySigned(ann.ID, ann.Key, ann.Sig, ann.goodbye())
+	if e != nil {
+		return BEACON_GOODBYE, ann.ID, nil, e
+	}
+	return BEACON_GOODBYE, ann.ID, ann, nil
+}
@@ -0,0 +1,34 @@
+package connection
+
+import (
+	"testing"
+	"time"
+)
+
+func FuzzParseBeacon(f *testing.F) {
+	conf := testConfig()
+	beacon := &Beacon{conf: conf, port: 4000}
+	f.Add(beacon.announcement())
+	f.Add(probePacket(conf.UUID))
+
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		limits := testLimits()
+		kind, id, ann, e := ParseBeacon(pkt, limits)
+		if uint64(len(id)) > limits.ID {
+			t.Fatalf("id of %d", len(id))
+		}
+		if e != nil || ann == nil {
+			return
+		}
+		if kind != BEACON_ANNOUNCE && kind != BEACON_GOODBYE || ann.ID != id {
+			t.Fatalf("kind %d for %q of %q", kind, ann.ID, id)
+		}
+		age := time.Since(ann.Time)
+		if age > BeaconMaxAge || age < -BeaconMaxAge {
+			t.Fatalf("stale beacon accepted: %v", age)
+		}
+		if verifySigned(ann.ID, ann.Key, ann.Sig, ann.message()) != nil && verifySigned(ann.ID, ann.Key, ann.Sig, ann.goodbye()) != nil {
+			t.Fatal("unsigned beacon accepted")
+		}
+	})
+}
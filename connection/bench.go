@@ -0,0 +1,303 @@
+package connection
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// BenchConnectTimeout bounds the handshake of each benchmark run.
+const BenchConnectTimeout = 5 * time.Second
+
+// BenchResult is how long one data loop took to move Bytes.
+type BenchResult struct {
+	Name     string
+	Bytes    uint64
+	Duration time.Duration
+}
+
+func (p BenchResult) String() string {
+	rate := float64(p.Bytes) / (1 << 20) / p.Duration.Seconds()
+	return fmt.Sprintf("%-36s %10s %9.1f MiB/s", p.Name, p.Duration.Round(time.Millisecond), rate)
+}
+
+// benchRun is the sender and the receiver of one data loop, chunk is
+// the biggest chunk sent.
+type benchRun struct {
+	name  string
+	chunk uint64
+	send  func(connection *Session, f *os.File, size, chunk uint64) error
+	recv  func(connection *Session, size, chunk uint64) error
+}
+
+// Benchmark sends size bytes of a temporary file over a TLS connection
+// on the loopback, first stop-and-wait with an ACK for every 1 KiB
+// chunk, then with the credit window and chunks up to bufSize, and
+// last over plain TCP with sendfile. Transfers always go through TLS
+// and can't be zero-copy, the last run is only the bound. The receiver drops the data, the
+// disk only slows the sender down. dir holds the certificate of the
+// device.
+func Benchmark(dir string, size, bufSize uint64) ([]BenchResult, error) {
+	os.MkdirAll(dir, 0777)
+	err := InitTLS(dir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := benchFile(size)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	addr, err := netip.ParseAddrPort(listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+
+	runs := []benchRun{{
+		name:  "stop-and-wait, 1 KiB chunks",
+		chunk: 1 << 10,
+		send:  sendStopAndWait,
+		recv:  recvStopAndWait,
+	}, {
+		name:  "credit window, 1 KiB chunks",
+		chunk: 1 << 10,
+		send:  sendWindow,
+		recv:  recvWindow,
+	}, {
+		name:  fmt.Sprintf("credit window, chunks up to %d KiB", bufSize>>10),
+		chunk: bufSize,
+		send:  sendWindow,
+		recv:  recvWindow,
+	}}
+
+	results := []BenchResult{}
+	for _, run := range runs {
+		_, err = f.Seek(0, 0)
+		if err != nil {
+			return results, err
+		}
+		duration, err := benchOnce(listener, addr, run, f, size)
+		if err != nil {
+			return results, fmt.Errorf("%s: %w", run.name, err)
+		}
+		results = append(results, BenchResult{Name: run.name, Bytes: size, Duration: duration})
+	}
+
+	duration, err := benchPlain(listener, f, size)
+	if err != nil {
+		return results, fmt.Errorf("plain TCP: %w", err)
+	}
+	results = append(results, BenchResult{Name: "plain TCP, sendfile", Bytes: size, Duration: duration})
+	return results, nil
+}
+
+func benchFile(size uint64) (*os.File, error) {
+	f, err := os.CreateTemp("", "jg_bench")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(f, rand.Reader, int64(size))
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+func benchOnce(listener net.Listener, addr netip.AddrPort, run benchRun, f *os.File, size uint64) (time.Duration, error) {
+	done := make(chan error, 1)
+	go func() {
+		conn, e := listener.Accept()
+		if e != nil {
+			done <- e
+			return
+		}
+		connection, e := AcceptHandshake(tls.Server(newTimedConn(conn, BenchConnectTimeout), serverTLS))
+		if e != nil {
+			conn.Close()
+			done <- e
+			return
+		}
+		defer connection.Close()
+		connection.SetTimeout(0)
+		done <- run.recv(connection, size, run.chunk)
+	}()
+
+	connection, e := Connect(context.Background(), addr, BenchConnectTimeout, 0)
+	if e != nil {
+		return 0, e
+	}
+	defer connection.Close()
+
+	start := time.Now()
+	e = run.send(connection, f, size, run.chunk)
+	if e != nil {
+		return 0, e
+	}
+	e = <-done
+	return time.Since(start), e
+}
+
+// benchPlain sends the file with sendFile over a connection without
+// TLS, the receiver answers a byte once it got everything.
+func benchPlain(listener net.Listener, f *os.File, size uint64) (time.Duration, error) {
+	done := make(chan error, 1)
+	go func() {
+		conn, e := listener.Accept()
+		if e != nil {
+			done <- e
+			return
+		}
+		defer conn.Close()
+		_, e = io.CopyN(io.Discard, conn, int64(size))
+		if e == nil {
+			_, e = conn.Write([]byte{DONE})
+		}
+		done <- e
+	}()
+
+	conn, e := net.DialTimeout("tcp", listener.Addr().String(), BenchConnectTimeout)
+	if e != nil {
+		return 0, e
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	e = sendFile(conn.(*net.TCPConn), f, 0, size)
+	if e != nil {
+		return 0, e
+	}
+	ack := make([]byte, 1)
+	_, e = io.ReadFull(conn, ack)
+	if e != nil {
+		return 0, e
+	}
+	e = <-done
+	return time.Since(start), e
+}
+
+// sendStopAndWait is the stop-and-wait data loop: OK, a chunk and then
+// the ACK of the receiver before the next one.
+func sendStopAndWait(connection *Session, f *os.File, size, chunk uint64) error {
+	buf := make([]byte, chunk)
+	for sent := uint64(0); sent < size; {
+		e := connection.WriteByte(OK)
+		if e != nil {
+			return e
+		}
+		t, e := f.Read(buf)
+		if e != nil {
+			return e
+		}
+		e = connection.WriteFrame(buf[:t])
+		if e != nil {
+			return e
+		}
+		ctl, e := connection.ReadByte()
+		if e != nil {
+			return e
+		}
+		if ctl != OK {
+			return errPeerCanceled
+		}
+		sent += uint64(t)
+	}
+	return nil
+}
+
+func recvStopAndWait(connection *Session, size, chunk uint64) error {
+	buf := make([]byte, chunk)
+	for got := uint64(0); got < size; {
+		ctl, e := connection.ReadByte()
+		if e != nil {
+			return e
+		}
+		if ctl != OK {
+			return errPeerCanceled
+		}
+		t, e := connection.ReadFrameInto(buf)
+		if e != nil {
+			return e
+		}
+		e = connection.WriteByte(OK)
+		if e != nil {
+			return e
+		}
+		got += uint64(t)
+	}
+	return nil
+}
+
+// sendWindow is the data loop of one stream of SendTrans with a single
+// range.
+func sendWindow(connection *Session, f *os.File, size, chunk uint64) error {
+	window, e := readWindow(connection)
+	if e != nil {
+		return e
+	}
+	flw := newFlow(window)
+	go flw.readControl(connection.Codec)
+	buf := make([]byte, frameHeader+chunk)
+	never := func() bool {
+		return false
+	}
+	e = streamFile(connection, flw, newChunkTuner(chunk), nil, f, 0, size, buf, never, func() {})
+	if e != nil {
+		return e
+	}
+	e = connection.WriteByte(DONE)
+	if e != nil {
+		return e
+	}
+	<-flw.done
+	if flw.Err() != errStreamDone {
+		return flw.Err()
+	}
+	return nil
+}
+
+func recvWindow(connection *Session, size, chunk uint64) error {
+	e := connection.WriteUint64(FlowWindow)
+	if e != nil {
+		return e
+	}
+	win := newWindow()
+	buf := make([]byte, chunk)
+	for got := uint64(0); got < size; {
+		t, _, e := win.readChunk(connection.Codec, buf, size-got)
+		if e != nil {
+			return e
+		}
+		got += uint64(t)
+		e = win.consume(connection.WriteAll, uint64(t), false)
+		if e != nil {
+			return e
+		}
+	}
+	ctl, e := connection.ReadByte()
+	if e != nil {
+		return e
+	}
+	if ctl != DONE {
+		return fmt.Errorf("%w: control %d", ErrProtocol, ctl)
+	}
+	e = win.consume(connection.WriteAll, 0, true)
+	if e != nil {
+		return e
+	}
+	return connection.WriteByte(DONE)
+}
@@ -0,0 +1,56 @@
+package connection
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+)
+
+// hashChunk is how much HashFileProgress reads at once.
+const hashChunk = 1 << 20
+
+var ErrChecksum = errors.New("checksum mismatch")
+
+// HashFile returns the SHA-256 digest of the file at p.
+func HashFile(p string) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// HashFileProgress is HashFile calling progress with the bytes of every
+// read, an error from progress stops it.
+func HashFileProgress(p string, progress func(n uint64) error) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	buf := make([]byte, hashChunk)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			e := progress(uint64(n))
+			if e != nil {
+				return nil, e
+			}
+		}
+		if err == io.EOF {
+			return h.Sum(nil), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package connection
+
+import "time"
+
+const (
+	// MinChunk is where the chunk size starts and the smallest it
+	// shrinks to, unless the configured buffer is smaller.
+	MinChunk = 16 << 10
+	// tunePeriod is how long the throughput is measured before the
+	// chunk size changes.
+	tunePeriod = 50 * time.Millisecond
+	// tuneMargin is the change in throughput taken as a real one.
+	tuneMargin = 0.05
+)
+
+// chunkTuner sizes the chunks of a transfer from the measured
+// throughput. It keeps doubling, or halving, the chunk while that pays
+// off, turns around when it gets worse and holds while it doesn't
+// change, never over max.
+type chunkTuner struct {
+	size  uint64
+	min   uint64
+	max   uint64
+	grow  bool
+	bytes uint64
+	start time.Time
+	last  float64
+}
+
+func newChunkTuner(max uint64) *chunkTuner {
+	min := uint64(MinChunk)
+	if min > max {
+		min = max
+	}
+	return &chunkTuner{
+		size:  min,
+		min:   min,
+		max:   max,
+		grow:  true,
+		start: time.Now(),
+	}
+}
+
+func (p *chunkTuner) Size() uint64 {
+	return p.size
+}
+
+// Sent counts n bytes written, once a period is over it moves the size.
+func (p *chunkTuner) Sent(n uint64) {
+	p.bytes += n
+	elapsed := time.Since(p.start)
+	if elapsed < tunePeriod {
+		return
+	}
+	rate := float64(p.bytes) / elapsed.Seconds()
+	p.bytes = 0
+	p.start = time.Now()
+
+	switch {
+	case p.last == 0 || rate > p.last*(1+tuneMargin):
+		p.step()
+	case rate < p.last*(1-tuneMargin):
+		p.grow = !p.grow
+		p.step()
+	}
+	p.last = rate
+}
+
+// step moves the size in the current direction, it stays at the bounds.
+func (p *chunkTuner) step() {
+	if p.grow {
+		p.size *= 2
+		if p.size > p.max {
+			p.size = p.max
+		}
+	} else {
+		p.size /= 2
+		if p.size < p.min {
+			p.size = p.min
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrProtocol = errors.New("protocol error")
+
+// Codec reads and writes the fields of the wire protocol: single control
+// bytes, little endian uint64s and frames (an uint64 length followed by
+// the payload). Reads always wait for the whole field, TCP is free to
+// deliver it in pieces.
+type Codec struct {
+	rw io.ReadWriter
+}
+
+func NewCodec(rw io.ReadWriter) *Codec {
+	return &Codec{rw: rw}
+}
+
+func (p *Codec) ReadFull(buf []byte) error {
+	_, e := io.ReadFull(p.rw, buf)
+	return e
+}
+
+func (p *Codec) WriteAll(buf []byte) error {
+	_, e := p.rw.Write(buf)
+	return e
+}
+
+func (p *Codec) ReadByte() (byte, error) {
+	b := make([]byte, 1)
+	e := p.ReadFull(b)
+	return b[0], e
+}
+
+func (p *Codec) WriteByte(b byte) error {
+	return p.WriteAll([]byte{b})
+}
+
+func (p *Codec) ReadUint64() (uint64, error) {
+	bint := make([]byte, 8)
+	e := p.ReadFull(bint)
+	return BytesToInt(bint), e
+}
+
+func (p *Codec) WriteUint64(n uint64) error {
+	return p.WriteAll(IntToBytes(n))
+}
+
+// ReadFrame reads a whole frame, frames longer than max are refused
+// before allocating them.
+func (p *Codec) ReadFrame(max uint64) ([]byte, error) {
+	size, e := p.ReadUint64()
+	if e != nil {
+		return nil, e
+	}
+	if size > max {
+		return nil, fmt.Errorf("%w: frame of %d bytes, limit %d", ErrProtocol, size, max)
+	}
+	buf := make([]byte, size)
+	e = p.ReadFull(buf)
+	return buf, e
+}
+
+// ReadFrameInto reads a frame into buf and returns its length.
+func (p *Codec) ReadFrameInto(buf []byte) (int, error) {
+	size, e := p.ReadUint64()
+	if e != nil {
+		return 0, e
+	}
+	if size > uint64(len(buf)) {
+		return 0, fmt.Errorf("%w: frame of %d bytes, limit %d", ErrProtocol, size, len(buf))
+	}
+	e = p.ReadFull(buf[:size])
+	return int(size), e
+}
+
+// WriteFrame sends the length and the payload in a single write.
+func (p *Codec) WriteFrame(payload []byte) error {
+	frame := make([]byte, 8+len(payload))
+	copy(frame, IntToBytes(uint64(len(payload))))
+	copy(frame[8:], payload)
+	return p.WriteAll(frame)
+}
+
+func (p *Codec) ReadString(max uint64) (string, error) {
+	buf, e := p.ReadFrame(max)
+	return string(buf), e
+}
+
+func (p *Codec) WriteString(s string) error {
+	return p.WriteFrame([]byte(s))
+}
@@ -0,0 +1,165 @@
+package connection
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/julioguillermo/jg_sender/config"
+)
+
+// A transfer that negotiated CompressDeflate may send a chunk as ZDATA:
+// the length of the chunk, then a frame with it deflated on its own.
+// Credits and progress keep counting the bytes of the files.
+
+// zframeHeader is the ZDATA byte, the chunk length and the frame length.
+const zframeHeader = 17
+
+const (
+	// sampleSize is how much of a file is deflated to judge it.
+	sampleSize = 64 << 10
+	// minSaving is the part of the sample deflate has to save, in
+	// percent, for the file to go compressed.
+	minSaving = 10
+)
+
+// packedExts are formats that are compressed already.
+var packedExts = map[string]bool{
+	".7z": true, ".aac": true, ".apk": true, ".avi": true, ".avif": true,
+	".br": true, ".bz2": true, ".docx": true, ".epub": true, ".flac": true,
+	".gif": true, ".gz": true, ".heic": true, ".heif": true, ".jar": true,
+	".jpeg": true, ".jpg": true, ".m4a": true, ".m4v": true, ".mkv": true,
+	".mov": true, ".mp3": true, ".mp4": true, ".odt": true, ".ogg": true,
+	".opus": true, ".png": true, ".pptx": true, ".rar": true, ".tgz": true,
+	".webm": true, ".webp": true, ".woff2": true, ".xlsx": true, ".xz": true,
+	".zip": true, ".zst": true,
+}
+
+// chooseCompress is the mode a receiver answers to the one offered,
+// none when it doesn't know it or its user turned compression off.
+func chooseCompress(offered, local uint64) uint64 {
+	if offered == config.CompressDeflate && local == config.CompressDeflate {
+		return offered
+	}
+	return config.CompressNone
+}
+
+// compressible tells if a file is worth deflating, by its extension and
+// then by how much a sample of it shrinks.
+func compressible(file string) bool {
+	if packedExts[strings.ToLower(path.Ext(file))] {
+		return false
+	}
+	f, e := os.Open(file)
+	if e != nil {
+		return false
+	}
+	defer f.Close()
+	sample := make([]byte, sampleSize)
+	n, e := io.ReadFull(f, sample)
+	if n == 0 {
+		return false
+	}
+	if e != nil && e != io.ErrUnexpectedEOF {
+		return false
+	}
+
+	var out bytes.Buffer
+	w, e := flate.NewWriter(&out, flate.BestSpeed)
+	if e != nil {
+		return false
+	}
+	w.Write(sample[:n])
+	w.Close()
+	return out.Len()*100 <= n*(100-minSaving)
+}
+
+// compressor deflates chunks for ZDATA frames while deflate is set, raw
+// and wire count what went through it. Chunks that don't shrink go out
+// as DATA.
+type compressor struct {
+	w       *flate.Writer
+	out     bytes.Buffer
+	deflate bool
+	raw     uint64
+	wire    uint64
+}
+
+func newCompressor() *compressor {
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return &compressor{w: w}
+}
+
+// dataFrame puts the DATA header in front of the t bytes of buf behind
+// it.
+func dataFrame(buf []byte, t int) []byte {
+	buf[0] = DATA
+	copy(buf[1:frameHeader], IntToBytes(uint64(t)))
+	return buf[:frameHeader+t]
+}
+
+// frame returns the t bytes of buf behind frameHeader as the smaller of
+// a ZDATA or DATA frame.
+func (p *compressor) frame(buf []byte, t int) []byte {
+	p.raw += uint64(t)
+	if !p.deflate {
+		p.wire += uint64(t)
+		return dataFrame(buf, t)
+	}
+	p.out.Reset()
+	p.out.Write(buf[:zframeHeader])
+	p.w.Reset(&p.out)
+	_, e := p.w.Write(buf[frameHeader : frameHeader+t])
+	if e == nil {
+		e = p.w.Close()
+	}
+	z := p.out.Bytes()
+	size := len(z) - zframeHeader
+	if e != nil || size >= t {
+		p.wire += uint64(t)
+		return dataFrame(buf, t)
+	}
+	z[0] = ZDATA
+	copy(z[1:9], IntToBytes(uint64(t)))
+	copy(z[9:zframeHeader], IntToBytes(uint64(size)))
+	p.wire += uint64(size)
+	return z
+}
+
+// inflater is the receiver side, it unpacks ZDATA chunks.
+type inflater struct {
+	r   io.ReadCloser
+	src bytes.Reader
+	buf []byte
+}
+
+func newInflater(size uint64) *inflater {
+	return &inflater{
+		r:   flate.NewReader(bytes.NewReader(nil)),
+		buf: make([]byte, size),
+	}
+}
+
+// unpack inflates z into dst, it has to fill dst exactly.
+func (p *inflater) unpack(z, dst []byte) error {
+	p.src.Reset(z)
+	e := p.r.(flate.Resetter).Reset(&p.src, nil)
+	if e != nil {
+		return e
+	}
+	_, e = io.ReadFull(p.r, dst)
+	if e == nil {
+		var extra [1]byte
+		if n, _ := p.r.Read(extra[:]); n > 0 {
+			e = io.ErrShortBuffer
+		}
+	}
+	if e != nil {
+		return fmt.Errorf("%w: bad compressed chunk: %v", ErrProtocol, e)
+	}
+	return nil
+}
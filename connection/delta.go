@@ -0,0 +1,339 @@
+package connection
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// A delta transfer sends a file against the copy of the same name the
+// receiver already has, like rsync. With its answer the receiver sends
+// the signatures of the blocks of that copy: a rolling weak checksum
+// and a strong hash each. The sender looks for those blocks at any
+// offset of the new file, and sends COPY with the index, the offset in
+// the new file, the offset in the old copy and the length for the ones
+// it finds. The rest goes as RANGE jobs. The new file replaces the old
+// copy once checked, the receiver has to accept that, without it no
+// copy is signed and the files arrive whole as new copies.
+
+const (
+	// DeltaBlock is the smallest block of a signature. Bigger files get
+	// bigger blocks, to keep within MaxDeltaBlocks.
+	DeltaBlock = 64 << 10
+	// MaxDeltaBlocks caps the signature of one file, MaxDeltaTotal the
+	// signatures of a whole transfer.
+	MaxDeltaBlocks = 1 << 16
+	MaxDeltaTotal  = 1 << 20
+	// MaxDeltaBlock caps the block size a receiver may pick.
+	MaxDeltaBlock = 1 << 30
+)
+
+const (
+	// strongSize is the part of the SHA-256 of a block that is kept,
+	// sigSize the weak checksum and that.
+	strongSize = 16
+	sigSize    = 4 + strongSize
+	// copyHeader is the COPY byte, the index and both offsets and the
+	// length.
+	copyHeader = 33
+	// deltaLiteral is the longest run of new data kept before sending
+	// it, the stream keeps moving while the scan looks for blocks.
+	deltaLiteral = 1 << 20
+	// deltaRead is how much the scan reads at once.
+	deltaRead = 4 << 20
+)
+
+// signature is the blocks of the receiver's copy of a file.
+type signature struct {
+	block  uint64
+	weak   map[uint32][]uint32
+	strong []byte
+}
+
+// deltaBlock is the block size for a copy of size.
+func deltaBlock(size uint64) uint64 {
+	block := uint64(DeltaBlock)
+	for size/block > MaxDeltaBlocks {
+		block <<= 1
+	}
+	return block
+}
+
+// weakSum is the rolling checksum of rsync: a is the sum of the bytes,
+// b weighs each one by its distance to the end. Both are mod 2^16.
+func weakSum(block []byte) (a, b uint32) {
+	n := uint32(len(block))
+	for i, x := range block {
+		a += uint32(x)
+		b += (n - uint32(i)) * uint32(x)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+func strongSum(block []byte) []byte {
+	sum := sha256.Sum256(block)
+	return sum[:strongSize]
+}
+
+var errSignTime = errors.New("no time left to sign the copy")
+
+// signFile reads the signature of the full blocks of the file at path,
+// it gives up at deadline.
+func signFile(path string, size uint64, deadline time.Time) (sig []byte, e error) {
+	block := deltaBlock(size)
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	count := size / block
+	sig = make([]byte, 0, count*sigSize)
+	buf := make([]byte, block)
+	for i := uint64(0); i < count; i++ {
+		if time.Now().After(deadline) {
+			return nil, errSignTime
+		}
+		_, e = io.ReadFull(f, buf)
+		if e != nil {
+			return nil, e
+		}
+		a, b := weakSum(buf)
+		sig = append(sig, IntToBytes(uint64(a | b<<16))[:4]...)
+		sig = append(sig, strongSum(buf)...)
+	}
+	return sig, nil
+}
+
+// parseSignature checks a signature sent by the receiver and indexes it
+// by the weak checksum.
+func parseSignature(block uint64, raw []byte) (*signature, error) {
+	if block < DeltaBlock || block > MaxDeltaBlock || block&(block-1) != 0 {
+		return nil, fmt.Errorf("%w: delta block of %d", ErrProtocol, block)
+	}
+	if len(raw)%sigSize != 0 {
+		return nil, fmt.Errorf("%w: signature of %d bytes", ErrProtocol, len(raw))
+	}
+	count := len(raw) / sigSize
+	sig := &signature{
+		block:  block,
+		weak:   make(map[uint32][]uint32, count),
+		strong: make([]byte, 0, count*strongSize),
+	}
+	for i := 0; i < count; i++ {
+		entry := raw[i*sigSize : (i+1)*sigSize]
+		weak := uint32(BytesToInt(entry[:4]))
+		sig.weak[weak] = append(sig.weak[weak], uint32(i))
+		sig.strong = append(sig.strong, entry[4:]...)
+	}
+	return sig, nil
+}
+
+// find returns the block of the copy that is data.
+func (p *signature) find(weak uint32, data []byte) (uint64, bool) {
+	list := p.weak[weak]
+	if len(list) == 0 {
+		return 0, false
+	}
+	strong := strongSum(data)
+	for _, i := range list {
+		if bytes.Equal(p.strong[i*strongSize:(i+1)*strongSize], strong) {
+			return uint64(i), true
+		}
+	}
+	return 0, false
+}
+
+// scanDelta walks f, of size, looking for the blocks of sig at every
+// offset. Runs of data the receiver lacks go to literal, blocks it has
+// go to copyBlock.
+func scanDelta(f io.Reader, size uint64, sig *signature, literal func(off, length uint64) error, copyBlock func(dst, src, length uint64) error) error {
+	block := sig.block
+	buf := make([]byte, block+deltaRead)
+	var (
+		data      []byte // the file from base on
+		base, pos uint64
+		lit       uint64 // start of the new data not sent yet
+		a, b      uint32
+		rolling   bool
+	)
+	// load keeps the block at pos and the byte after it in data
+	load := func() error {
+		need := pos + block + 1
+		if need > size {
+			need = size
+		}
+		end := base + uint64(len(data))
+		if need <= end {
+			return nil
+		}
+		n := copy(buf, data[pos-base:])
+		read := uint64(len(buf) - n)
+		if rest := size - end; read > rest {
+			read = rest
+		}
+		_, e := io.ReadFull(f, buf[n:n+int(read)])
+		if e != nil {
+			return e
+		}
+		data = buf[:n+int(read)]
+		base = pos
+		return nil
+	}
+
+	for pos+block <= size {
+		e := load()
+		if e != nil {
+			return e
+		}
+		window := data[pos-base : pos-base+block]
+		if !rolling {
+			a, b = weakSum(window)
+			rolling = true
+		}
+		if src, ok := sig.find(a|b<<16, window); ok {
+			if pos > lit {
+				e = literal(lit, pos-lit)
+				if e != nil {
+					return e
+				}
+			}
+			e = copyBlock(pos, src*block, block)
+			if e != nil {
+				return e
+			}
+			pos += block
+			lit = pos
+			rolling = false
+			continue
+		}
+		if pos-lit >= deltaLiteral {
+			e = literal(lit, pos-lit)
+			if e != nil {
+				return e
+			}
+			lit = pos
+		}
+		if pos+block == size {
+			break
+		}
+		// Roll one byte, the arithmetic wraps mod 2^32 and the mask
+		// takes it to 2^16
+		out, in := uint32(data[pos-base]), uint32(data[pos-base+block])
+		a = (a - out + in) & 0xffff
+		b = (b - uint32(block)*out + a) & 0xffff
+		pos++
+	}
+	if size > lit {
+		return literal(lit, size-lit)
+	}
+	return nil
+}
+
+// fileSig is the signature of the copy of file index.
+type fileSig struct {
+	index uint64
+	block uint64
+	sig   []byte
+}
+
+// deltaSignatures signs the copies the receiver has of the files of a
+// delta transfer that start from scratch, within MaxDeltaTotal blocks
+// and until deadline. The files left go whole.
+func deltaSignatures(trans *FileTransfer, deadline time.Time) []fileSig {
+	if !trans.Replace {
+		return nil
+	}
+	sigs := []fileSig{}
+	total := uint64(0)
+	for i, file := range trans.Files {
+		if file.Done || file.Prog != 0 || file.Size < DeltaBlock {
+			continue
+		}
+		inf, e := os.Stat(file.Path)
+		if e != nil || !inf.Mode().IsRegular() || inf.Size() < DeltaBlock {
+			continue
+		}
+		size := uint64(inf.Size())
+		block := deltaBlock(size)
+		if total+size/block > MaxDeltaTotal {
+			break
+		}
+		sig, e := signFile(file.Path, size, deadline)
+		if e == errSignTime {
+			break
+		}
+		if e != nil {
+			continue
+		}
+		total += size / block
+		sigs = append(sigs, fileSig{index: uint64(i), block: block, sig: sig})
+	}
+	return sigs
+}
+
+func writeSignatures(codec *Codec, sigs []fileSig) error {
+	e := codec.WriteUint64(uint64(len(sigs)))
+	if e != nil {
+		return e
+	}
+	for _, s := range sigs {
+		e = codec.WriteUint64(s.index)
+		if e != nil {
+			return e
+		}
+		e = codec.WriteUint64(s.block)
+		if e != nil {
+			return e
+		}
+		e = codec.WriteFrame(s.sig)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// readSignatures reads the signatures sent for the files of a delta
+// transfer, only files that start from scratch may have one.
+func readSignatures(codec *Codec, files []*Element) (map[int]*signature, error) {
+	count, e := codec.ReadUint64()
+	if e != nil {
+		return nil, e
+	}
+	if count > uint64(len(files)) {
+		return nil, overLimit("signatures", count, uint64(len(files)))
+	}
+	sigs := map[int]*signature{}
+	total := uint64(0)
+	for i := uint64(0); i < count; i++ {
+		index, e := codec.ReadUint64()
+		if e != nil {
+			return nil, e
+		}
+		if index >= uint64(len(files)) || files[index].Done || files[index].Prog != 0 || sigs[int(index)] != nil {
+			return nil, fmt.Errorf("%w: signature of file %d", ErrProtocol, index)
+		}
+		block, e := codec.ReadUint64()
+		if e != nil {
+			return nil, e
+		}
+		raw, e := codec.ReadFrame(MaxDeltaBlocks * sigSize)
+		if e != nil {
+			return nil, e
+		}
+		total += uint64(len(raw) / sigSize)
+		if total > MaxDeltaTotal {
+			return nil, overLimit("signature blocks", total, MaxDeltaTotal)
+		}
+		sig, e := parseSignature(block, raw)
+		if e != nil {
+			return nil, e
+		}
+		sigs[int(index)] = sig
+	}
+	return sigs, nil
+}
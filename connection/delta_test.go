@@ -0,0 +1,41 @@
+package connection
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzReadSignatures(f *testing.F) {
+	var buf bytes.Buffer
+	writeSignatures(NewCodec(&buf), []fileSig{
+		{index: 0, block: DeltaBlock, sig: make([]byte, 2*sigSize)},
+		{index: 2, block: 2 * DeltaBlock, sig: make([]byte, sigSize)},
+	})
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		files := []*Element{
+			{Size: 3 * DeltaBlock},
+			{Size: DeltaBlock, Prog: DeltaBlock, Done: true},
+			{Size: 4 * DeltaBlock},
+			{Size: 2 * DeltaBlock, Prog: 1},
+		}
+		sigs, e := readSignatures(NewCodec(bytes.NewBuffer(data)), files)
+		if e != nil {
+			return
+		}
+		total := 0
+		for i, sig := range sigs {
+			if i < 0 || i >= len(files) || files[i].Done || files[i].Prog != 0 {
+				t.Fatalf("signature of file %d", i)
+			}
+			if sig.block < DeltaBlock || sig.block > MaxDeltaBlock || sig.block&(sig.block-1) != 0 {
+				t.Fatalf("block of %d", sig.block)
+			}
+			total += len(sig.strong) / strongSize
+		}
+		if total > MaxDeltaTotal {
+			t.Fatalf("%d signature blocks", total)
+		}
+	})
+}
@@ -0,0 +1,329 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// FlowWindow is how many bytes the receiver lets the sender have in
+	// flight, enough to fill a gigabit link with a few ms of latency.
+	FlowWindow = 4 << 20
+	// CreditInterval is the longest the receiver keeps consumed bytes
+	// before granting them back, slow links still see credits flowing.
+	CreditInterval = time.Second
+	// CancelDrain is how long the side that cancels waits for the peer
+	// to hang up, closing first could reset the cancel away.
+	CancelDrain = 2 * time.Second
+	// cancelPoll is how often a sender waiting for credit looks at its
+	// own cancel flag.
+	cancelPoll = 100 * time.Millisecond
+)
+
+// frameHeader is the DATA byte and the length in front of each chunk.
+const frameHeader = 9
+
+var (
+	errPeerCanceled = errors.New("canceled by the peer")
+	errCanceled     = errors.New("canceled")
+	errStreamDone   = errors.New("stream done")
+)
+
+// flow is the sender side of the credit window. readControl hands it
+// what the receiver sends back on a stream: CREDIT, the OK or ERROR of
+// each file it checked, CANCELED and DONE. The receiver only grants
+// what it already wrote, so acked is the progress that survives a
+// crash.
+type flow struct {
+	mu     sync.Mutex
+	credit uint64
+	acked  uint64
+	err    error
+	wake   chan struct{}
+	done   chan struct{}
+
+	// verdict gets the index of each file checked by the receiver,
+	// an error ends the stream.
+	verdict func(index uint64, ok bool) error
+}
+
+func newFlow(window uint64) *flow {
+	return &flow{
+		credit: window,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+func (p *flow) grant(n uint64) {
+	p.mu.Lock()
+	p.credit += n
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *flow) ack(n uint64) {
+	p.mu.Lock()
+	p.acked += n
+	p.mu.Unlock()
+	p.grant(n)
+}
+
+// Acked is how many bytes the receiver wrote so far.
+func (p *flow) Acked() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.acked
+}
+
+func (p *flow) fail(e error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = e
+		close(p.done)
+	}
+}
+
+// Err is why the control stream ended, errPeerCanceled when the
+// receiver canceled and errStreamDone when it answered DONE.
+func (p *flow) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// take waits for credit and returns up to max bytes of it. It returns 0
+// once canceled reports true.
+func (p *flow) take(max uint64, canceled func() bool) (uint64, error) {
+	for {
+		p.mu.Lock()
+		if p.credit > 0 {
+			n := max
+			if n > p.credit {
+				n = p.credit
+			}
+			p.credit -= n
+			p.mu.Unlock()
+			return n, nil
+		}
+		err := p.err
+		p.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if canceled() {
+			return 0, nil
+		}
+		select {
+		case <-p.wake:
+		case <-p.done:
+		case <-time.After(cancelPoll):
+		}
+	}
+}
+
+// wait gives the peer timeout to hang up after a cancel.
+func (p *flow) wait(timeout time.Duration) {
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+	}
+}
+
+func (p *flow) readControl(codec *Codec) {
+	for {
+		ctl, e := codec.ReadByte()
+		if e != nil {
+			p.fail(e)
+			return
+		}
+		switch ctl {
+		case CREDIT:
+			n, e := codec.ReadUint64()
+			if e != nil {
+				p.fail(e)
+				return
+			}
+			if n > FlowWindow<<4 {
+				p.fail(overLimit("credit", n, FlowWindow<<4))
+				return
+			}
+			p.ack(n)
+		case OK, ERROR:
+			index, e := codec.ReadUint64()
+			if e != nil {
+				p.fail(e)
+				return
+			}
+			if p.verdict == nil {
+				p.fail(fmt.Errorf("%w: unexpected verdict", ErrProtocol))
+				return
+			}
+			e = p.verdict(index, ctl == OK)
+			if e != nil {
+				p.fail(e)
+				return
+			}
+		case CANCELED:
+			p.fail(errPeerCanceled)
+			return
+		case DONE:
+			p.fail(errStreamDone)
+			return
+		default:
+			p.fail(fmt.Errorf("%w: control %d", ErrProtocol, ctl))
+			return
+		}
+	}
+}
+
+// drain reads what the peer still sends until it hangs up, so the
+// CANCELED just written isn't lost to a reset.
+func drain(connection *Session) {
+	connection.SetTimeout(CancelDrain)
+	io.Copy(io.Discard, connection.Conn)
+}
+
+// streamFile sends r, positioned at sent, up to size as DATA frames,
+// or deflated when z is set. Each chunk is read straight behind its
+// header in buf and written once, buf must hold frameHeader plus the
+// biggest chunk of tuner. progress runs after every frame.
+func streamFile(connection *Session, flw *flow, tuner *chunkTuner, z *compressor, r io.Reader, sent, size uint64, buf []byte, canceled func() bool, progress func()) error {
+	for sent < size {
+		if canceled() {
+			return errCanceled
+		}
+		chunk := tuner.Size()
+		if rest := size - sent; chunk > rest {
+			chunk = rest
+		}
+		n, e := flw.take(chunk, canceled)
+		if e != nil {
+			return e
+		}
+		if n == 0 {
+			continue
+		}
+
+		t, e := r.Read(buf[frameHeader : frameHeader+n])
+		if e != nil {
+			return e
+		}
+		// A short read gives back the credit it didn't use
+		if uint64(t) < n {
+			flw.grant(n - uint64(t))
+		}
+		var frame []byte
+		if z != nil {
+			frame = z.frame(buf, t)
+		} else {
+			frame = dataFrame(buf, t)
+		}
+		e = connection.WriteAll(frame)
+		if e != nil {
+			return e
+		}
+
+		sent += uint64(t)
+		tuner.Sent(uint64(t))
+		progress()
+	}
+	return nil
+}
+
+// window is the receiver side of the credit window, it checks the
+// sender keeps within it and grants the written bytes back in batches.
+type window struct {
+	credit   uint64
+	consumed uint64
+	granted  time.Time
+
+	// inflate is set when the transfer negotiated compression
+	inflate *inflater
+}
+
+func newWindow() *window {
+	return &window{
+		credit:  FlowWindow,
+		granted: time.Now(),
+	}
+}
+
+// readChunk reads the next DATA or ZDATA frame into buf, rest is what
+// is left of the range. It returns the bytes of the chunk and the ones
+// it took on the wire, errPeerCanceled when the sender cancels.
+func (p *window) readChunk(codec *Codec, buf []byte, rest uint64) (int, int, error) {
+	ctl, e := codec.ReadByte()
+	if e != nil {
+		return 0, 0, e
+	}
+	var t, wire int
+	switch ctl {
+	case CANCELED:
+		return 0, 0, errPeerCanceled
+	case DATA:
+		t, e = codec.ReadFrameInto(buf)
+		if e != nil {
+			return 0, 0, e
+		}
+		wire = t
+	case ZDATA:
+		if p.inflate == nil {
+			return 0, 0, fmt.Errorf("%w: compressed chunk not negotiated", ErrProtocol)
+		}
+		size, e := codec.ReadUint64()
+		if e != nil {
+			return 0, 0, e
+		}
+		if size > uint64(len(buf)) {
+			return 0, 0, overLimit("chunk", size, uint64(len(buf)))
+		}
+		wire, e = codec.ReadFrameInto(p.inflate.buf)
+		if e != nil {
+			return 0, 0, e
+		}
+		t = int(size)
+		e = p.inflate.unpack(p.inflate.buf[:wire], buf[:t])
+		if e != nil {
+			return 0, 0, e
+		}
+	default:
+		return 0, 0, fmt.Errorf("%w: control %d", ErrProtocol, ctl)
+	}
+	if uint64(t) > rest {
+		return 0, 0, fmt.Errorf("%w: chunk past the end of the range", ErrProtocol)
+	}
+	if uint64(t) > p.credit {
+		return 0, 0, overLimit("chunk", uint64(t), p.credit)
+	}
+	p.credit -= uint64(t)
+	return t, wire, nil
+}
+
+// consume counts n more bytes as written and grants them back with
+// write when there are enough of them or they waited too long, force
+// grants them now.
+func (p *window) consume(write func([]byte) error, n uint64, force bool) error {
+	p.consumed += n
+	if p.consumed == 0 || !force && p.consumed < FlowWindow/4 && time.Since(p.granted) < CreditInterval {
+		return nil
+	}
+	credit := make([]byte, 9)
+	credit[0] = CREDIT
+	copy(credit[1:], IntToBytes(p.consumed))
+	e := write(credit)
+	if e != nil {
+		return e
+	}
+	p.credit += p.consumed
+	p.consumed = 0
+	p.granted = time.Now()
+	return nil
+}
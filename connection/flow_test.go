@@ -0,0 +1,47 @@
+package connection
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+)
+
+func FuzzReadChunk(f *testing.F) {
+	data := bytes.Repeat([]byte("chunk"), 100)
+	var plain bytes.Buffer
+	codec := NewCodec(&plain)
+	codec.WriteByte(DATA)
+	codec.WriteFrame(data)
+	f.Add(plain.Bytes(), true)
+
+	var z bytes.Buffer
+	w, _ := flate.NewWriter(&z, flate.BestSpeed)
+	w.Write(data)
+	w.Close()
+	var packed bytes.Buffer
+	codec = NewCodec(&packed)
+	codec.WriteByte(ZDATA)
+	codec.WriteUint64(uint64(len(data)))
+	codec.WriteFrame(z.Bytes())
+	f.Add(packed.Bytes(), true)
+	f.Add([]byte{CANCELED}, false)
+
+	const size = 4096
+	f.Fuzz(func(t *testing.T, pkt []byte, deflate bool) {
+		win := newWindow()
+		if deflate {
+			win.inflate = newInflater(size)
+		}
+		buf := make([]byte, size)
+		n, wire, e := win.readChunk(NewCodec(bytes.NewBuffer(pkt)), buf, size/2)
+		if e != nil {
+			return
+		}
+		if n < 0 || n > size/2 || wire < 0 || wire > size {
+			t.Fatalf("chunk of %d from %d bytes", n, wire)
+		}
+		if win.credit != FlowWindow-uint64(n) {
+			t.Fatalf("credit %d after %d bytes", win.credit, n)
+		}
+	})
+}
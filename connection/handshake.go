@@ -0,0 +1,309 @@
+package connection
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Protocol version spoken by this build and the oldest one it still
+// understands. New commands and fields are negotiated with the feature
+// bits, the minimum only moves when older peers can't be served safely:
+// since 13 the signatures cover the TLS session, older ones could be
+// relayed.
+const (
+	ProtocolVersion    = uint64(13)
+	MinProtocolVersion = uint64(13)
+)
+
+// Feature bits exchanged in the handshake. The negotiated set is the
+// intersection of both peers.
+const (
+	FeatureMSG = uint64(1) << iota
+	FeatureResources
+	FeatureContinue
+	FeatureUserView
+	FeaturePair
+	FeatureStreams
+	FeatureCompress
+	FeatureDelta
+)
+
+const Features = FeatureMSG | FeatureResources | FeatureContinue | FeatureUserView | FeaturePair | FeatureStreams |
+	FeatureCompress | FeatureDelta
+
+var (
+	ErrIncompatible = errors.New("incompatible version")
+	ErrUnsupported  = errors.New("feature not supported by peer")
+)
+
+const NonceSize = 32
+
+// Session is a connection that already passed the handshake. Nonce is the
+// challenge the peer has to sign, PeerNonce the one we sign, Binding the
+// keying material of the TLS session both signatures cover.
+type Session struct {
+	net.Conn
+	*Codec
+	Version     uint64
+	Features    uint64
+	Fingerprint string
+	Binding     []byte
+	Nonce       []byte
+	PeerNonce   []byte
+
+	// The identity the peer proved with a signature
+	peerID  string
+	peerKey []byte
+
+	timed *timedConn
+	stop  chan struct{}
+	once  sync.Once
+}
+
+func newSession(connection net.Conn, codec *Codec) (*Session, error) {
+	binding, e := channelBinding(connection)
+	if e != nil {
+		return nil, e
+	}
+	return &Session{
+		Conn:        connection,
+		Codec:       codec,
+		Fingerprint: peerFingerprint(connection),
+		Binding:     binding,
+		timed:       timedOf(connection),
+		stop:        make(chan struct{}),
+	}, nil
+}
+
+// SetTimeout changes how long a read or write may wait for the peer,
+// zero waits while the connection is alive.
+func (p *Session) SetTimeout(timeout time.Duration) {
+	if p.timed != nil {
+		p.timed.SetTimeout(timeout)
+	}
+}
+
+// Bind closes the connection once ctx is done.
+func (p *Session) Bind(ctx context.Context) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Conn.Close()
+		case <-p.stop:
+		}
+	}()
+}
+
+func (p *Session) Close() error {
+	p.once.Do(func() {
+		close(p.stop)
+	})
+	return p.Conn.Close()
+}
+
+func (p *Session) Supports(feature uint64) bool {
+	return p.Features&feature == feature
+}
+
+// Pin checks the peer certificate, and the key it signed with, against
+// the ones pinned for id. Only a peer that proved to be id is pinned on
+// first contact.
+func (p *Session) Pin(id string) error {
+	if Pins == nil {
+		return ErrPinMismatch
+	}
+	var key []byte
+	if p.peerID == id {
+		key = p.peerKey
+	}
+	return Pins.Check(id, p.Fingerprint, key)
+}
+
+func tlsHandshake(connection net.Conn) error {
+	tc, ok := connection.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	return tc.Handshake()
+}
+
+func commandFeature(cmd byte) uint64 {
+	switch cmd {
+	case MSG:
+		return FeatureMSG
+	case RESOURCES:
+		return FeatureResources
+	case CONT_TRANS:
+		return FeatureContinue
+	case USER_VIEW:
+		return FeatureUserView
+	case PAIR:
+		return FeaturePair
+	case STREAM:
+		return FeatureStreams
+	}
+	return 0
+}
+
+func compatible(version uint64) bool {
+	return version >= MinProtocolVersion
+}
+
+func negotiate(version uint64) uint64 {
+	if version < ProtocolVersion {
+		return version
+	}
+	return ProtocolVersion
+}
+
+func writeHello(codec *Codec, version, features uint64) error {
+	hello := make([]byte, 0, len(CTL)+16)
+	hello = append(hello, CTL...)
+	hello = append(hello, IntToBytes(version)...)
+	hello = append(hello, IntToBytes(features)...)
+	return codec.WriteAll(hello)
+}
+
+func readHello(codec *Codec) (version, features uint64, e error) {
+	magic := make([]byte, len(CTL))
+	e = codec.ReadFull(magic)
+	if e != nil {
+		return
+	}
+	if !CheckCTL(magic) {
+		e = fmt.Errorf("%w: unknown protocol", ErrIncompatible)
+		return
+	}
+	version, e = codec.ReadUint64()
+	if e != nil {
+		return
+	}
+	features, e = codec.ReadUint64()
+	return
+}
+
+// exchangeNonces sends a fresh challenge and reads the peer's one.
+func (p *Session) exchangeNonces() error {
+	p.Nonce = make([]byte, NonceSize)
+	_, e := rand.Read(p.Nonce)
+	if e != nil {
+		return e
+	}
+	e = p.WriteAll(p.Nonce)
+	if e != nil {
+		return e
+	}
+	p.PeerNonce = make([]byte, NonceSize)
+	return p.ReadFull(p.PeerNonce)
+}
+
+// Handshake runs the client side of the handshake on a fresh connection.
+func Handshake(connection net.Conn) (*Session, error) {
+	e := tlsHandshake(connection)
+	if e != nil {
+		return nil, e
+	}
+	codec := NewCodec(connection)
+	e = writeHello(codec, ProtocolVersion, Features)
+	if e != nil {
+		return nil, e
+	}
+	version, features, e := readHello(codec)
+	if e != nil {
+		return nil, e
+	}
+	status, e := codec.ReadByte()
+	if e != nil {
+		return nil, e
+	}
+	if status != OK || !compatible(version) {
+		return nil, fmt.Errorf("%w: peer v%d, local v%d", ErrIncompatible, version, ProtocolVersion)
+	}
+	session, e := newSession(connection, codec)
+	if e != nil {
+		return nil, e
+	}
+	session.Version = version
+	session.Features = features & Features
+	e = session.exchangeNonces()
+	if e != nil {
+		return nil, e
+	}
+	return session, nil
+}
+
+// AcceptHandshake runs the server side of the handshake.
+func AcceptHandshake(connection net.Conn) (*Session, error) {
+	e := tlsHandshake(connection)
+	if e != nil {
+		return nil, e
+	}
+	codec := NewCodec(connection)
+	version, features, e := readHello(codec)
+	if e != nil {
+		return nil, e
+	}
+	ok := compatible(version)
+	session, e := newSession(connection, codec)
+	if e != nil {
+		return nil, e
+	}
+	session.Version = negotiate(version)
+	session.Features = features & Features
+	e = writeHello(codec, session.Version, session.Features)
+	if e != nil {
+		return nil, e
+	}
+	if !ok {
+		codec.WriteByte(ERROR)
+		return nil, fmt.Errorf("%w: peer v%d, local v%d", ErrIncompatible, version, ProtocolVersion)
+	}
+	e = codec.WriteByte(OK)
+	if e != nil {
+		return nil, e
+	}
+	e = session.exchangeNonces()
+	if e != nil {
+		return nil, e
+	}
+	return session, nil
+}
+
+// Connect dials addr over TLS and performs the handshake within
+// connect. Then every read and write may wait idle for the peer, the
+// session is closed when ctx is done.
+func Connect(ctx context.Context, addr netip.AddrPort, connect, idle time.Duration) (*Session, error) {
+	if clientTLS == nil {
+		return nil, errors.New("tls not initialized")
+	}
+	dialer := net.Dialer{Timeout: connect}
+	conn, e := dialer.DialContext(ctx, "tcp", addr.String())
+	if e != nil {
+		return nil, e
+	}
+	timed := newTimedConn(conn, connect)
+	connection := tls.Client(timed, clientTLS)
+	session, e := Handshake(connection)
+	if e != nil {
+		connection.Close()
+		return nil, e
+	}
+	timed.SetTimeout(idle)
+	session.Bind(ctx)
+	return session, nil
+}
+
+// Command sends cmd once the peer agreed on the feature it needs.
+func (p *Session) Command(cmd byte) error {
+	if !p.Supports(commandFeature(cmd)) {
+		return ErrUnsupported
+	}
+	return p.WriteByte(cmd)
+}
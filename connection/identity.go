@@ -0,0 +1,64 @@
+package connection
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+
+	"github.com/julioguillermo/jg_sender/config"
+)
+
+// Labels keep a signature made for one message from being replayed as
+// another one.
+const (
+	SignName   = "jg_sender/name"
+	SignUser   = "jg_sender/user"
+	SignBeacon = "jg_sender/beacon"
+	SignMDNS   = "jg_sender/mdns"
+	// SignGoodbye is for the beacon a device sends when it shuts down.
+	SignGoodbye = "jg_sender/goodbye"
+)
+
+var ErrSpoofed = errors.New("spoofed identity")
+
+func signedMessage(label string, nonce []byte, fields ...string) []byte {
+	var msg bytes.Buffer
+	msg.WriteString(label)
+	msg.Write(nonce)
+	for _, f := range fields {
+		msg.Write(IntToBytes(uint64(len(f))))
+		msg.WriteString(f)
+	}
+	return msg.Bytes()
+}
+
+// Sign answers the peer's challenge.
+func (p *Session) Sign(conf *config.Config, label string, fields ...string) []byte {
+	return conf.Sign(signedMessage(label, p.challenge(p.PeerNonce), fields...))
+}
+
+// Verify checks that id belongs to pub and that the peer signed fields
+// together with our challenge. Pin keeps pub for id once it verified.
+func (p *Session) Verify(id string, pub, sig []byte, label string, fields ...string) error {
+	e := verifySigned(id, pub, sig, signedMessage(label, p.challenge(p.Nonce), fields...))
+	if e == nil {
+		p.peerID, p.peerKey = id, pub
+	}
+	return e
+}
+
+// challenge puts the keying material of the TLS session in front of
+// nonce, a signature relayed from another connection doesn't verify.
+func (p *Session) challenge(nonce []byte) []byte {
+	return append(append([]byte{}, p.Binding...), nonce...)
+}
+
+func verifySigned(id string, pub, sig, msg []byte) error {
+	if len(pub) != ed25519.PublicKeySize || config.DeviceID(pub) != id {
+		return ErrSpoofed
+	}
+	if !ed25519.Verify(pub, msg, sig) {
+		return ErrSpoofed
+	}
+	return nil
+}
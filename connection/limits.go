@@ -0,0 +1,57 @@
+package connection
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/julioguillermo/jg_sender/config"
+)
+
+// Sizes of the fixed length fields.
+const (
+	MaxKey  = ed25519.PublicKeySize
+	MaxSig  = ed25519.SignatureSize
+	MaxHash = sha256.Size
+	MaxOS   = 64
+)
+
+// Limits bounds what a peer can make us allocate or write, anything
+// larger is a protocol error.
+type Limits struct {
+	ID       uint64
+	Name     uint64
+	MSG      uint64
+	Files    uint64
+	FileName uint64
+	BufSize  uint64
+	Manifest uint64
+}
+
+func NewLimits(conf *config.Config) *Limits {
+	return &Limits{
+		ID:       conf.MaxID(),
+		Name:     conf.MaxName(),
+		MSG:      conf.MaxMSG(),
+		Files:    conf.MaxFiles(),
+		FileName: conf.MaxFileName(),
+		BufSize:  conf.MaxBufSize(),
+		Manifest: conf.MaxManifest(),
+	}
+}
+
+// readPort reads the port a peer listens on.
+func readPort(codec *Codec) (uint16, error) {
+	port, e := codec.ReadUint64()
+	if e != nil {
+		return 0, e
+	}
+	if port == 0 || port > 0xffff {
+		return 0, fmt.Errorf("%w: port %d", ErrProtocol, port)
+	}
+	return uint16(port), nil
+}
+
+func overLimit(field string, value, max uint64) error {
+	return fmt.Errorf("%w: %s of %d, limit %d", ErrProtocol, field, value, max)
+}
@@ -5,11 +5,17 @@ import (
 	"time"
 )
 
+// Element is a file of a transfer. Prog counts the bytes the receiver
+// wrote, Parts splits it by segment for files sent over several
+// streams. Done is set once the receiver checked the file.
 type Element struct {
-	Path string
-	Name string
-	Size uint64
-	Prog uint64
+	Path  string
+	Name  string
+	Size  uint64
+	Prog  uint64
+	Hash  []byte
+	Parts []uint64 `json:",omitempty"`
+	Done  bool
 }
 
 type FileTransfer struct {
@@ -18,6 +24,28 @@ type FileTransfer struct {
 	TransBytes uint64
 	TotalBytes uint64
 	Canceled   bool
+
+	// Waiting is set while the receiver decides, Dir is the folder
+	// the receiver accepted the files to.
+	Waiting bool
+	Dir     string
+
+	// Hashing is set while the sender digests the files, Hashed is
+	// how many bytes of them it read.
+	Hashing bool
+	Hashed  uint64
+
+	// Compress is the mode both peers agreed on. Wire is how many bytes
+	// went over the network for Raw bytes of the files.
+	Compress uint64
+	Wire     uint64
+	Raw      uint64
+
+	// Delta sends the files against the copies of the same name the
+	// receiver has. Replace is set when the receiver accepted to
+	// replace them, the files arrive as new copies otherwise.
+	Delta   bool
+	Replace bool
 }
 
 type Transfer struct {
@@ -32,93 +60,103 @@ type Transfer struct {
 	File     *FileTransfer
 }
 
-type Device struct {
-	ID     string
-	Addr   *netip.Addr
-	Name   string
-	OS     string
-	Not    uint64
-	Online bool
-}
-
-var History = []*Transfer{}
-var Devices = []*Device{}
-
-// History ######################################
-func GetUserHistory(userid string) []*Transfer {
-	his := []*Transfer{}
-	for _, t := range History {
-		if t.UserID == userid {
-			his = append(his, t)
+// clone copies t with its files, the copy doesn't change with t.
+func (p *Transfer) clone() *Transfer {
+	t := *p
+	if p.File != nil {
+		file := *p.File
+		file.Files = make([]*Element, len(p.File.Files))
+		for i, f := range p.File.Files {
+			e := *f
+			e.Parts = append([]uint64(nil), f.Parts...)
+			file.Files[i] = &e
 		}
+		t.File = &file
 	}
-	return his
+	return &t
 }
 
-func UserView(userid string) {
-	for _, t := range History {
-		if t.UserID == userid {
-			t.View = true
-		}
-	}
-}
+// MaxDeviceAddrs and MaxDeviceNames are how many of the last addresses
+// and names of a device are kept in its book.
+const (
+	MaxDeviceAddrs = 8
+	MaxDeviceNames = 8
+)
 
-func FindTrans(id string) int {
-	for i, d := range History {
-		if d.ID == id {
-			return i
-		}
-	}
-	return -1
-}
+// Device is a peer, Host is set for devices added by hostname and is
+// resolved again on every connect. Names and Addrs are what the device
+// used since it was first seen, the latest last. Alias and Favorite are
+// set by the user.
+type Device struct {
+	ID      string
+	Addr    *netip.AddrPort
+	Host    string
+	Name    string
+	OS      string
+	Not     uint64
+	Online  bool
+	Warning string
 
-func GetTrans(id string) *Transfer {
-	index := FindTrans(id)
-	if index == -1 {
-		return nil
-	}
-	return History[index]
+	Alias     string
+	Favorite  bool
+	Names     []string
+	Addrs     []netip.AddrPort
+	FirstSeen time.Time
+	LastSeen  time.Time
 }
 
-func SetTrans(id string, d *Transfer) {
-	index := FindTrans(id)
-	if index == -1 {
-		History = append(History, d)
-		return
+// clone copies d with its book, the copy doesn't change with d.
+func (p *Device) clone() *Device {
+	d := *p
+	if p.Addr != nil {
+		addr := *p.Addr
+		d.Addr = &addr
 	}
-	History[index] = d
+	d.Names = append([]string(nil), p.Names...)
+	d.Addrs = append([]netip.AddrPort(nil), p.Addrs...)
+	return &d
 }
 
-// Device ######################################
-func FindDevice(id string) int {
-	for i, d := range Devices {
-		if d.ID == id {
-			return i
-		}
+// Title is the alias of the device or, without one, its name.
+func (p *Device) Title() string {
+	if p.Alias != "" {
+		return p.Alias
 	}
-	return -1
+	return p.Name
 }
 
-func GetDevice(id string) *Device {
-	index := FindDevice(id)
-	if index == -1 {
-		return nil
+// remember stamps the device as seen now with name and addr.
+func (p *Device) remember(name string, addr *netip.AddrPort) {
+	now := time.Now()
+	if p.FirstSeen.IsZero() {
+		p.FirstSeen = now
 	}
-	return Devices[index]
-}
+	p.LastSeen = now
 
-func SetDevice(id string, d *Device) {
-	index := FindDevice(id)
-	if index != -1 {
-		d.Not = Devices[index].Not
-		Devices = append(Devices[:index], Devices[index+1:]...)
+	if name != "" {
+		names := []string{}
+		for _, n := range p.Names {
+			if n != name {
+				names = append(names, n)
+			}
+		}
+		names = append(names, name)
+		if len(names) > MaxDeviceNames {
+			names = names[len(names)-MaxDeviceNames:]
+		}
+		p.Names = names
 	}
-	d.Online = true
-	Devices = append([]*Device{d}, Devices...)
-}
-
-func InvalidateDevices() {
-	for _, d := range Devices {
-		d.Online = false
+	if addr != nil {
+		addrs := []netip.AddrPort{}
+		for _, a := range p.Addrs {
+			if a != *addr {
+				addrs = append(addrs, a)
+			}
+		}
+		addrs = append(addrs, *addr)
+		if len(addrs) > MaxDeviceAddrs {
+			addrs = addrs[len(addrs)-MaxDeviceAddrs:]
+		}
+		p.Addrs = addrs
 	}
 }
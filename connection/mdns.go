@@ -0,0 +1,565 @@
+package connection
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/julioguillermo/jg_sender/config"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// DNS-SD names, see RFC 6762 and RFC 6763.
+const (
+	MDNSService  = "_jgsender._tcp.local."
+	mdnsServices = "_services._dns-sd._udp.local."
+	mdnsPort     = 5353
+)
+
+const (
+	MDNSTTL           = 120
+	MDNSQueryInterval = time.Minute
+	// Responses with this bit in the class replace the cached records,
+	// questions with it ask for a unicast answer.
+	mdnsCacheFlush = 1 << 15
+	mdnsMaxSize    = 9000
+	// A TXT string holds up to 255 bytes
+	mdnsMaxTXT = 255
+)
+
+var (
+	mdnsGroup  = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+	mdnsGroup6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: mdnsPort}
+)
+
+var ErrNoTXT = errors.New("incomplete service record")
+
+// MDNS advertises this device as a DNS-SD service and browses for the
+// other ones, over IPv4 and IPv6.
+type MDNS struct {
+	ctx   context.Context
+	conf  *config.Config
+	port  uint16
+	socks []*mdnsSocket
+}
+
+// mdnsSocket is the group of one IP version.
+type mdnsSocket struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+	iface func(*net.Interface) error
+}
+
+// StartMDNS answers queries and browses until ctx is done, Goodbye must
+// be sent before. It fails when neither IPv4 nor IPv6 can be used, port is the
+// one the server announces.
+func StartMDNS(ctx context.Context, conf *config.Config, port uint16) (*MDNS, error) {
+	mdns := &MDNS{
+		ctx:  ctx,
+		conf: conf,
+		port: port,
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err == nil {
+		pc := ipv4.NewPacketConn(conn)
+		for _, ifi := range linkInterfaces() {
+			ifi := ifi
+			pc.JoinGroup(&ifi, mdnsGroup)
+		}
+		// Other instances on this host listen on the same socket address
+		pc.SetMulticastLoopback(true)
+		mdns.socks = append(mdns.socks, &mdnsSocket{conn, mdnsGroup, pc.SetMulticastInterface})
+	}
+	conn, err6 := net.ListenMulticastUDP("udp6", nil, mdnsGroup6)
+	if err6 == nil {
+		pc := ipv6.NewPacketConn(conn)
+		for _, ifi := range linkInterfaces() {
+			ifi := ifi
+			pc.JoinGroup(&ifi, mdnsGroup6)
+		}
+		pc.SetMulticastLoopback(true)
+		mdns.socks = append(mdns.socks, &mdnsSocket{conn, mdnsGroup6, pc.SetMulticastInterface})
+	}
+	if len(mdns.socks) == 0 {
+		return nil, err
+	}
+
+	for _, sock := range mdns.socks {
+		go mdns.listen(sock)
+	}
+	go mdns.loop()
+	return mdns, nil
+}
+
+// Browse asks for every instance of the service.
+func (p *MDNS) Browse() error {
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(MDNSService),
+			Type:  dnsmessage.TypePTR,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	return p.multicastAll(&msg)
+}
+
+func (p *MDNS) loop() {
+	// Announce twice as RFC 6762 asks, then keep browsing
+	p.announce(MDNSTTL)
+	p.Browse()
+	select {
+	case <-p.ctx.Done():
+	case <-time.After(time.Second):
+		p.announce(MDNSTTL)
+	}
+
+	ticker := time.NewTicker(MDNSQueryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			for _, sock := range p.socks {
+				sock.conn.Close()
+			}
+			return
+		case <-ticker.C:
+			e := p.Browse()
+			if e != nil {
+				log.Println("mdns", e)
+			}
+		}
+	}
+}
+
+// Goodbye withdraws the records of this device from the caches, peers
+// ignore it and notice with the presence check.
+func (p *MDNS) Goodbye() {
+	p.announce(0)
+}
+
+// announce sends every record unsolicited, a ttl of 0 withdraws them.
+func (p *MDNS) announce(ttl uint32) {
+	records, e := p.records(ttl)
+	if e != nil {
+		log.Println("mdns", e)
+		return
+	}
+	msg := dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: records,
+	}
+	e = p.multicastAll(&msg)
+	if e != nil {
+		log.Println("mdns", e)
+	}
+}
+
+// multicastAll sends msg to the groups of every IP version.
+func (p *MDNS) multicastAll(msg *dnsmessage.Message) error {
+	var err error
+	sent := false
+	for _, sock := range p.socks {
+		e := sock.multicast(msg)
+		if e != nil {
+			err = e
+		} else {
+			sent = true
+		}
+	}
+	if sent {
+		return nil
+	}
+	return err
+}
+
+// multicast sends msg on every interface, it only fails when none
+// could be used.
+func (p *mdnsSocket) multicast(msg *dnsmessage.Message) error {
+	pkt, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	inters := linkInterfaces()
+	if len(inters) == 0 {
+		_, err = p.conn.WriteToUDP(pkt, p.group)
+		return err
+	}
+	sent := false
+	for _, ifi := range inters {
+		ifi := ifi
+		e := p.iface(&ifi)
+		if e == nil {
+			_, e = p.conn.WriteToUDP(pkt, p.group)
+		}
+		if e != nil {
+			err = e
+		} else {
+			sent = true
+		}
+	}
+	if sent {
+		return nil
+	}
+	return err
+}
+
+// instanceLabel is the user friendly name of the instance, the ID keeps
+// devices with the same name apart.
+func instanceLabel(name, id string) string {
+	if len(id) > 6 {
+		id = id[:6]
+	}
+	suffix := " (" + id + ")"
+	name = strings.ReplaceAll(name, ".", " ")
+	if len(name)+len(suffix) > 63 {
+		name = strings.ToValidUTF8(name[:63-len(suffix)], "")
+	}
+	return name + suffix
+}
+
+// hostLabel turns the device name into a hostname.
+func hostLabel(name, id string) string {
+	var host strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if r < utf8.RuneSelf && (r >= 'a' && r <= 'z' || r >= '0' && r <= '9') {
+			host.WriteRune(r)
+		} else {
+			host.WriteByte('-')
+		}
+	}
+	label := strings.Trim(host.String(), "-")
+	if len(label) > 63 {
+		label = strings.TrimRight(label[:63], "-")
+	}
+	if label == "" {
+		if len(id) > 8 {
+			id = id[:8]
+		}
+		label = "jgsender-" + id
+	}
+	return label
+}
+
+func (p *MDNS) names() (instance, host dnsmessage.Name, e error) {
+	name := p.conf.Name()
+	instance, e = dnsmessage.NewName(instanceLabel(name, p.conf.UUID) + "." + MDNSService)
+	if e != nil {
+		return
+	}
+	host, e = dnsmessage.NewName(hostLabel(name, p.conf.UUID) + ".local.")
+	return
+}
+
+func mdnsSigned(ann *Announcement) []byte {
+	return signedMessage(SignMDNS, nil, ann.ID, ann.Name, ann.OS, fmt.Sprint(ann.Port))
+}
+
+// txt describes this device, the key and signature tie the name to the
+// ID like the beacon does.
+func (p *MDNS) txt() []string {
+	name := p.conf.Name()
+	if len(name) > mdnsMaxTXT-len("name=") {
+		name = strings.ToValidUTF8(name[:mdnsMaxTXT-len("name=")], "")
+	}
+	ann := &Announcement{
+		ID:   p.conf.UUID,
+		Name: name,
+		OS:   p.conf.OS(),
+		Port: p.port,
+	}
+	sig := p.conf.Sign(mdnsSigned(ann))
+	return []string{
+		"id=" + ann.ID,
+		"name=" + ann.Name,
+		"os=" + ann.OS,
+		"ver=" + fmt.Sprint(ProtocolVersion),
+		"port=" + fmt.Sprint(ann.Port),
+		"key=" + base64.StdEncoding.EncodeToString(p.conf.PublicKey()),
+		"sig=" + base64.StdEncoding.EncodeToString(sig),
+	}
+}
+
+func mdnsHeader(name dnsmessage.Name, kind dnsmessage.Type, ttl uint32, unique bool) dnsmessage.ResourceHeader {
+	class := dnsmessage.ClassINET
+	if unique {
+		class |= mdnsCacheFlush
+	}
+	return dnsmessage.ResourceHeader{Name: name, Type: kind, Class: class, TTL: ttl}
+}
+
+// records returns PTR, SRV, TXT and the address records of this device.
+func (p *MDNS) records(ttl uint32) ([]dnsmessage.Resource, error) {
+	instance, host, e := p.names()
+	if e != nil {
+		return nil, e
+	}
+	service := dnsmessage.MustNewName(MDNSService)
+	records := []dnsmessage.Resource{
+		{
+			Header: mdnsHeader(service, dnsmessage.TypePTR, ttl, false),
+			Body:   &dnsmessage.PTRResource{PTR: instance},
+		},
+		{
+			Header: mdnsHeader(instance, dnsmessage.TypeSRV, ttl, true),
+			Body:   &dnsmessage.SRVResource{Target: host, Port: p.port},
+		},
+		{
+			Header: mdnsHeader(instance, dnsmessage.TypeTXT, ttl, true),
+			Body:   &dnsmessage.TXTResource{TXT: p.txt()},
+		},
+	}
+	return append(records, p.hostRecords(host, ttl)...), nil
+}
+
+func (p *MDNS) hostRecords(host dnsmessage.Name, ttl uint32) []dnsmessage.Resource {
+	records := []dnsmessage.Resource{}
+	for _, ip := range advertised(p.conf) {
+		if ip.Is4() {
+			records = append(records, dnsmessage.Resource{
+				Header: mdnsHeader(host, dnsmessage.TypeA, ttl, true),
+				Body:   &dnsmessage.AResource{A: ip.As4()},
+			})
+		} else {
+			records = append(records, dnsmessage.Resource{
+				Header: mdnsHeader(host, dnsmessage.TypeAAAA, ttl, true),
+				Body:   &dnsmessage.AAAAResource{AAAA: ip.As16()},
+			})
+		}
+	}
+	return records
+}
+
+func (p *MDNS) listen(sock *mdnsSocket) {
+	buf := make([]byte, mdnsMaxSize)
+	for {
+		n, from, err := sock.conn.ReadFromUDP(buf)
+		if err != nil {
+			if p.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		var msg dnsmessage.Message
+		if msg.Unpack(buf[:n]) != nil {
+			continue
+		}
+		if msg.Response {
+			p.collect(&msg, from)
+		} else {
+			p.answer(sock, &msg, from)
+		}
+	}
+}
+
+func sameName(a dnsmessage.Name, b string) bool {
+	return strings.EqualFold(a.String(), b)
+}
+
+// answer replies to the questions about this device.
+func (p *MDNS) answer(sock *mdnsSocket, query *dnsmessage.Message, from *net.UDPAddr) {
+	instance, host, e := p.names()
+	if e != nil {
+		return
+	}
+	records, e := p.records(MDNSTTL)
+	if e != nil {
+		return
+	}
+	ptr, srv, txt, addrs := records[0], records[1], records[2], records[3:]
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true, Authoritative: true},
+	}
+	unicast := false
+	for _, q := range query.Questions {
+		all := q.Type == dnsmessage.TypeALL
+		switch {
+		case sameName(q.Name, MDNSService) && (all || q.Type == dnsmessage.TypePTR):
+			msg.Answers = append(msg.Answers, ptr)
+			msg.Additionals = append(append(msg.Additionals, srv, txt), addrs...)
+		case sameName(q.Name, mdnsServices) && (all || q.Type == dnsmessage.TypePTR):
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: mdnsHeader(q.Name, dnsmessage.TypePTR, MDNSTTL, false),
+				Body:   &dnsmessage.PTRResource{PTR: ptr.Header.Name},
+			})
+		case sameName(q.Name, instance.String()):
+			if all || q.Type == dnsmessage.TypeSRV {
+				msg.Answers = append(msg.Answers, srv)
+				msg.Additionals = append(msg.Additionals, addrs...)
+			}
+			if all || q.Type == dnsmessage.TypeTXT {
+				msg.Answers = append(msg.Answers, txt)
+			}
+		case sameName(q.Name, host.String()) && (all || q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA):
+			msg.Answers = append(msg.Answers, addrs...)
+		default:
+			continue
+		}
+		if q.Class&mdnsCacheFlush != 0 {
+			unicast = true
+		}
+	}
+	if len(msg.Answers) == 0 {
+		return
+	}
+
+	// Legacy resolvers don't listen on the mDNS port, they get a plain
+	// DNS answer
+	if from.Port != mdnsPort {
+		msg.ID = query.ID
+		msg.Questions = query.Questions
+		for _, records := range [][]dnsmessage.Resource{msg.Answers, msg.Additionals} {
+			for i := range records {
+				records[i].Header.Class &^= mdnsCacheFlush
+			}
+		}
+		unicast = true
+	}
+	if unicast {
+		pkt, e := msg.Pack()
+		if e == nil {
+			sock.conn.WriteToUDP(pkt, from)
+		}
+		return
+	}
+	sock.multicast(&msg)
+}
+
+// collect merges the instances found in a response into Records. The
+// records are signed without a time and the addresses not at all, so
+// goodbyes are ignored and a device only moves once it answers there.
+func (p *MDNS) collect(msg *dnsmessage.Message, from *net.UDPAddr) {
+	txts := map[string][]string{}
+	targets := map[string]string{}
+	hosts := map[string][]netip.Addr{}
+	for _, r := range append(msg.Answers, msg.Additionals...) {
+		if r.Header.TTL == 0 {
+			continue
+		}
+		name := strings.ToLower(r.Header.Name.String())
+		switch body := r.Body.(type) {
+		case *dnsmessage.TXTResource:
+			txts[name] = body.TXT
+		case *dnsmessage.SRVResource:
+			targets[name] = strings.ToLower(body.Target.String())
+		case *dnsmessage.AResource:
+			hosts[name] = append(hosts[name], netip.AddrFrom4(body.A))
+		case *dnsmessage.AAAAResource:
+			hosts[name] = append(hosts[name], netip.AddrFrom16(body.AAAA))
+		}
+	}
+
+	limits := NewLimits(p.conf)
+	for instance, txt := range txts {
+		if !strings.HasSuffix(instance, MDNSService) {
+			continue
+		}
+		ann, e := ParseTXT(txt, limits)
+		if e != nil {
+			if errors.Is(e, ErrProtocol) || e == ErrSpoofed {
+				log.Println(from, e)
+			}
+			continue
+		}
+		if ann.ID == p.conf.UUID {
+			continue
+		}
+		ip, ok := hostAddr(hosts[targets[instance]], from)
+		if !ok {
+			continue
+		}
+		addr := netip.AddrPortFrom(ip, ann.Port)
+		announced(p.ctx, p.conf, &Device{
+			ID:   ann.ID,
+			Addr: &addr,
+			Name: ann.Name,
+			OS:   ann.OS,
+		})
+	}
+}
+
+// ParseTXT reads and verifies the TXT record of an instance.
+func ParseTXT(txt []string, limits *Limits) (*Announcement, error) {
+	fields := map[string]string{}
+	for _, kv := range txt {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(kv[:i])
+		if _, ok := fields[key]; !ok {
+			fields[key] = kv[i+1:]
+		}
+	}
+	for _, key := range []string{"id", "name", "os", "port", "key", "sig"} {
+		if _, ok := fields[key]; !ok {
+			return nil, ErrNoTXT
+		}
+	}
+
+	ann := &Announcement{
+		ID:   fields["id"],
+		Name: fields["name"],
+		OS:   fields["os"],
+	}
+	if uint64(len(ann.ID)) > limits.ID {
+		return nil, overLimit("id", uint64(len(ann.ID)), limits.ID)
+	}
+	if uint64(len(ann.Name)) > limits.Name {
+		return nil, overLimit("name", uint64(len(ann.Name)), limits.Name)
+	}
+	if len(ann.OS) > MaxOS {
+		return nil, overLimit("os", uint64(len(ann.OS)), MaxOS)
+	}
+	port, e := strconv.ParseUint(fields["port"], 10, 16)
+	if e != nil || port == 0 {
+		return nil, fmt.Errorf("%w: port %q", ErrProtocol, fields["port"])
+	}
+	ann.Port = uint16(port)
+	ann.Key, e = base64.StdEncoding.DecodeString(fields["key"])
+	if e != nil {
+		return nil, fmt.Errorf("%w: key: %v", ErrProtocol, e)
+	}
+	ann.Sig, e = base64.StdEncoding.DecodeString(fields["sig"])
+	if e != nil {
+		return nil, fmt.Errorf("%w: sig: %v", ErrProtocol, e)
+	}
+	e = verifySigned(ann.ID, ann.Key, ann.Sig, mdnsSigned(ann))
+	if e != nil {
+		return nil, e
+	}
+	return ann, nil
+}
+
+// hostAddr prefers an address of the same family as the response, the
+// source address is only used when the host records are missing.
+func hostAddr(addrs []netip.Addr, from *net.UDPAddr) (netip.Addr, bool) {
+	src, ok := netip.AddrFromSlice(from.IP)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	src = src.Unmap()
+	for _, addr := range addrs {
+		if addr.Is4() != src.Is4() {
+			continue
+		}
+		if addr.IsLinkLocalUnicast() {
+			addr = addr.WithZone(from.Zone)
+		}
+		return addr, true
+	}
+	if len(addrs) > 0 {
+		return addrs[0], true
+	}
+	return src.WithZone(from.Zone), true
+}
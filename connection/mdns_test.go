@@ -0,0 +1,26 @@
+package connection
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzParseTXT(f *testing.F) {
+	mdns := &MDNS{conf: testConfig(), port: 4000}
+	f.Add(strings.Join(mdns.txt(), "\n"))
+	f.Add("id=\nname=\nos=\nport=1\nkey=\nsig=")
+
+	f.Fuzz(func(t *testing.T, txt string) {
+		limits := testLimits()
+		ann, e := ParseTXT(strings.Split(txt, "\n"), limits)
+		if e != nil {
+			return
+		}
+		if uint64(len(ann.ID)) > limits.ID || uint64(len(ann.Name)) > limits.Name || len(ann.OS) > MaxOS || ann.Port == 0 {
+			t.Fatalf("announcement over the limits: %+v", ann)
+		}
+		if verifySigned(ann.ID, ann.Key, ann.Sig, mdnsSigned(ann)) != nil {
+			t.Fatal("unsigned TXT accepted")
+		}
+	})
+}
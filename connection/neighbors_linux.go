@@ -0,0 +1,81 @@
+//go:build linux
+// +build linux
+
+package connection
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+// Neighbor states that don't hold a reachable address.
+const (
+	nudIncomplete = 0x01
+	nudFailed     = 0x20
+	nudNoARP      = 0x40
+)
+
+const (
+	// sizeof(struct ndmsg)
+	ndmsgSize = 12
+	ndaDst    = 1
+)
+
+// Neighbors returns the IPv6 neighbor cache of the kernel.
+func Neighbors() ([]netip.Addr, error) {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, syscall.AF_INET6)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := []netip.Addr{}
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWNEIGH || len(m.Data) < ndmsgSize {
+			continue
+		}
+		index := *(*int32)(unsafe.Pointer(&m.Data[4]))
+		state := *(*uint16)(unsafe.Pointer(&m.Data[8]))
+		if state&(nudIncomplete|nudFailed|nudNoARP) != 0 {
+			continue
+		}
+		addr, ok := neighborDst(m.Data[ndmsgSize:])
+		if !ok {
+			continue
+		}
+		if addr.IsLinkLocalUnicast() {
+			ifi, err := net.InterfaceByIndex(int(index))
+			if err != nil {
+				continue
+			}
+			addr = addr.WithZone(ifi.Name)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// neighborDst finds the NDA_DST attribute.
+func neighborDst(attrs []byte) (netip.Addr, bool) {
+	for len(attrs) >= syscall.SizeofRtAttr {
+		size := int(*(*uint16)(unsafe.Pointer(&attrs[0])))
+		kind := *(*uint16)(unsafe.Pointer(&attrs[2]))
+		if size < syscall.SizeofRtAttr || size > len(attrs) {
+			break
+		}
+		if kind == ndaDst {
+			return netip.AddrFromSlice(attrs[syscall.SizeofRtAttr:size])
+		}
+		size = (size + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+		if size > len(attrs) {
+			break
+		}
+		attrs = attrs[size:]
+	}
+	return netip.Addr{}, false
+}
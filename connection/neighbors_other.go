@@ -0,0 +1,35 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package connection
+
+import (
+	"bufio"
+	"bytes"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// Neighbors returns the IPv6 neighbor cache as ndp lists it.
+func Neighbors() ([]netip.Addr, error) {
+	out, err := exec.Command("ndp", "-an").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := []netip.Addr{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[1] == "(incomplete)" {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil || addr.IsMulticast() {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, scanner.Err()
+}
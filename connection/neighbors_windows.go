@@ -0,0 +1,47 @@
+package connection
+
+import (
+	"bufio"
+	"bytes"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Neighbors returns the IPv6 neighbor cache as netsh lists it.
+func Neighbors() ([]netip.Addr, error) {
+	cmd := exec.Command("netsh", "interface", "ipv6", "show", "neighbors")
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := []netip.Addr{}
+	zone := ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			// "Interface 12: Ethernet", the word is translated
+			if len(fields) > 1 && strings.HasSuffix(fields[1], ":") {
+				zone = strings.TrimSuffix(fields[1], ":")
+			}
+			continue
+		}
+		// Entries without a link-layer address are incomplete
+		if len(fields) < 3 || !addr.Is6() || addr.IsMulticast() {
+			continue
+		}
+		if addr.IsLinkLocalUnicast() && zone != "" {
+			addr = addr.WithZone(zone)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, scanner.Err()
+}
@@ -0,0 +1,266 @@
+package connection
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/netip"
+	"time"
+
+	"github.com/julioguillermo/jg_sender/config"
+)
+
+const PairCodeDigits = 6
+
+// PairInterval is how often an address may ask to pair, each request
+// shows a code.
+const PairInterval = 10 * time.Second
+
+var (
+	ErrNotPaired     = errors.New("not allowed, pair with this device first")
+	ErrPairRefused   = errors.New("pairing refused")
+	ErrPairCanceled  = errors.New("pairing canceled")
+	ErrPairWrongCode = errors.New("pairing failed: wrong code")
+)
+
+func NewPairCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < PairCodeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", PairCodeDigits, n), nil
+}
+
+// pairTranscript binds the code to both identities and to the challenges
+// and the TLS session of this connection.
+func pairTranscript(connection *Session, clientID, serverID string, clientNonce, serverNonce []byte) []byte {
+	nonces := append(append([]byte{}, clientNonce...), serverNonce...)
+	return signedMessage("jg_sender/pair", connection.challenge(nonces), clientID, serverID)
+}
+
+func pairMAC(code, label string, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(code))
+	mac.Write([]byte(label))
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
+
+// allowed tells if userID may use cmd given the pairing policy.
+func (p *Server) allowed(userID string, cmd byte) bool {
+	if p.conf.IsTrusted(userID) {
+		return true
+	}
+	switch p.conf.Unpaired() {
+	case config.UnpairedAll:
+		return true
+	case config.UnpairedMessages:
+		return cmd == MSG || cmd == USER_VIEW
+	}
+	return false
+}
+
+// permit answers DENIED to a request header the policy doesn't allow.
+func (p *Server) permit(connection *Session, userID string, cmd byte) bool {
+	if p.allowed(userID, cmd) {
+		return true
+	}
+	log.Println(userID, ErrNotPaired)
+	connection.WriteByte(DENIED)
+	return false
+}
+
+// accept answers a request header with OK or DENIED.
+func (p *Server) accept(connection *Session, userID string, cmd byte) bool {
+	if !p.permit(connection, userID, cmd) {
+		return false
+	}
+	return connection.WriteByte(OK) == nil
+}
+
+// accepted reads the answer of a request header.
+func accepted(connection *Session) error {
+	status, e := connection.ReadByte()
+	if e != nil {
+		return e
+	}
+	if status == DENIED {
+		return ErrNotPaired
+	}
+	if status != OK {
+		return errors.New("request rejected")
+	}
+	return nil
+}
+
+func (p *Server) pairDone(userID string, e error) {
+	if p.PairResult != nil {
+		p.PairResult(userID, e)
+	}
+}
+
+// Pair runs the side that types the code shown by the other device.
+func (p *Server) Pair(ctx context.Context, userID string) {
+	e := p.pair(ctx, userID)
+	p.pairDone(userID, e)
+}
+
+func (p *Server) pair(ctx context.Context, userID string) error {
+	dev := Records.Device(userID)
+	if dev == nil {
+		return errors.New("user not found")
+	}
+	if p.PairCode == nil {
+		return ErrPairCanceled
+	}
+
+	connection, e := p.dial(ctx, dev)
+	if e != nil {
+		return e
+	}
+	defer connection.Close()
+
+	e = connection.Command(PAIR)
+	if e != nil {
+		return e
+	}
+	e = p.SendUser(connection, "")
+	if e != nil {
+		return e
+	}
+
+	// The peer is showing the code
+	ctl, e := connection.ReadByte()
+	if e != nil {
+		return e
+	}
+	if ctl != OK {
+		return ErrPairRefused
+	}
+
+	code, ok := p.PairCode(userID)
+	if !ok {
+		connection.WriteByte(CANCELED)
+		return ErrPairCanceled
+	}
+
+	transcript := pairTranscript(connection, p.conf.UUID, userID, connection.Nonce, connection.PeerNonce)
+	e = connection.WriteAll(append([]byte{OK}, pairMAC(code, "client", transcript)...))
+	if e != nil {
+		return e
+	}
+
+	ctl, e = connection.ReadByte()
+	if e != nil {
+		return e
+	}
+	if ctl != OK {
+		return ErrPairWrongCode
+	}
+	proof := make([]byte, sha256.Size)
+	e = connection.ReadFull(proof)
+	if e != nil {
+		return e
+	}
+	if !hmac.Equal(proof, pairMAC(code, "server", transcript)) {
+		return ErrPairWrongCode
+	}
+
+	return p.conf.Trust(&config.TrustedDevice{
+		ID:     userID,
+		Name:   dev.Name,
+		Paired: time.Now(),
+	})
+}
+
+// mayPair tells if addr can ask to pair now.
+func (p *Server) mayPair(addr netip.Addr) bool {
+	p.pairMu.Lock()
+	defer p.pairMu.Unlock()
+	if p.pairs == nil {
+		p.pairs = map[netip.Addr]time.Time{}
+	}
+	now := time.Now()
+	if now.Sub(p.pairs[addr]) < PairInterval {
+		return false
+	}
+	p.pairs[addr] = now
+	for a, t := range p.pairs {
+		if now.Sub(t) >= PairInterval {
+			delete(p.pairs, a)
+		}
+	}
+	return true
+}
+
+// GetPair runs the side that shows the code.
+func (p *Server) GetPair(connection *Session) {
+	userID, userName, _, _, e := p.GetUser(connection)
+	if e != nil {
+		return
+	}
+	if !p.mayPair(remoteAddr(connection)) {
+		log.Println(connection.RemoteAddr(), "asks to pair too often")
+		connection.WriteByte(DENIED)
+		return
+	}
+	if p.ShowPairCode == nil {
+		connection.WriteByte(DENIED)
+		return
+	}
+	code, e := NewPairCode()
+	if e != nil {
+		connection.WriteByte(ERROR)
+		return
+	}
+	defer func() {
+		p.pairDone(userID, e)
+	}()
+
+	p.ShowPairCode(userID, userName, code)
+	e = connection.WriteByte(OK)
+	if e != nil {
+		return
+	}
+
+	// The peer's user is typing the code
+	connection.SetTimeout(ApprovalTimeout)
+	ctl, e := connection.ReadByte()
+	if e != nil {
+		return
+	}
+	if ctl != OK {
+		e = ErrPairCanceled
+		return
+	}
+	proof := make([]byte, sha256.Size)
+	e = connection.ReadFull(proof)
+	if e != nil {
+		return
+	}
+
+	transcript := pairTranscript(connection, userID, p.conf.UUID, connection.PeerNonce, connection.Nonce)
+	if !hmac.Equal(proof, pairMAC(code, "client", transcript)) {
+		connection.WriteByte(ERROR)
+		e = ErrPairWrongCode
+		return
+	}
+	e = connection.WriteAll(append([]byte{OK}, pairMAC(code, "server", transcript)...))
+	if e != nil {
+		return
+	}
+
+	e = p.conf.Trust(&config.TrustedDevice{
+		ID:     userID,
+		Name:   userName,
+		Paired: time.Now(),
+	})
+}
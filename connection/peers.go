@@ -0,0 +1,191 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julioguillermo/jg_sender/config"
+)
+
+var ErrBadPeer = errors.New("invalid address")
+
+// ParsePeer reads an IP or hostname with an optional port: "10.0.0.2",
+// "pc.lan:9200", "fe80::1%eth0" or "[fe80::1%eth0]:9200". Without a port
+// the default one is used.
+func ParsePeer(s string) (host string, port uint16, err error) {
+	s = strings.TrimSpace(s)
+	if addr, e := netip.ParseAddr(strings.Trim(s, "[]")); e == nil {
+		return addr.String(), config.Port, nil
+	}
+	host, sport, e := net.SplitHostPort(s)
+	if e != nil {
+		host, sport = s, fmt.Sprint(config.Port)
+	}
+	n, e := strconv.ParseUint(sport, 10, 16)
+	if e != nil || n == 0 {
+		return "", 0, fmt.Errorf("%w: port %q", ErrBadPeer, sport)
+	}
+	if _, e := netip.ParseAddr(host); e != nil && !validHostname(host) {
+		return "", 0, fmt.Errorf("%w: %q", ErrBadPeer, host)
+	}
+	return host, uint16(n), nil
+}
+
+func validHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// resolve looks host up, IPv4 first since it's the most likely to be
+// routed.
+func resolve(ctx context.Context, host string, port uint16) (netip.AddrPort, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return netip.AddrPortFrom(addr, port), nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if len(addrs) == 0 {
+		return netip.AddrPort{}, fmt.Errorf("%s: no address", host)
+	}
+	best := addrs[0]
+	for _, addr := range addrs {
+		if addr.Unmap().Is4() {
+			best = addr
+			break
+		}
+	}
+	return netip.AddrPortFrom(best.Unmap(), port), nil
+}
+
+// queryName asks addr for its signed identity with the NAME command. A
+// certificate that doesn't match the pinned one fails, the device at
+// addr is not to be recorded.
+func queryName(ctx context.Context, conf *config.Config, addr netip.AddrPort, connect, idle time.Duration) (*Device, error) {
+	conn, err := Connect(ctx, addr, connect, idle)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = conn.Command(NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	limits := NewLimits(conf)
+	uuid, err := conn.ReadString(limits.ID)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := conn.ReadFrame(MaxKey)
+	if err != nil {
+		return nil, err
+	}
+	name, err := conn.ReadString(limits.Name)
+	if err != nil {
+		return nil, err
+	}
+	os, err := conn.ReadString(MaxOS)
+	if err != nil {
+		return nil, err
+	}
+	port, err := readPort(conn.Codec)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := conn.ReadFrame(MaxSig)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.Verify(uuid, pub, sig, SignName, uuid, name, os, fmt.Sprint(port))
+	if err != nil {
+		return nil, err
+	}
+	err = conn.Pin(uuid)
+	if err != nil {
+		return nil, fmt.Errorf("%s at %s: %w", uuid, addr, err)
+	}
+
+	addr = netip.AddrPortFrom(addr.Addr(), port)
+	dev := &Device{
+		ID:   uuid,
+		Addr: &addr,
+		Name: name,
+		OS:   os,
+	}
+	return dev, nil
+}
+
+// AddPeer probes entry with NAME and keeps the device, a hostname is
+// resolved again on every connect.
+func (p *Server) AddPeer(ctx context.Context, entry string) (*Device, error) {
+	host, port, err := ParsePeer(entry)
+	if err != nil {
+		return nil, err
+	}
+	lookup, cancel := context.WithTimeout(ctx, p.conf.ConnectTimeout())
+	addr, err := resolve(lookup, host, port)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	dev, err := queryName(ctx, p.conf, addr, p.conf.ConnectTimeout(), p.conf.IdleTimeout())
+	if err != nil {
+		return nil, err
+	}
+	if _, e := netip.ParseAddr(host); e != nil {
+		dev.Host = host
+	}
+	Records.SetDevice(dev)
+	return dev, nil
+}
+
+// ProbePeers adds the static peers of the config that answer.
+func (p *Server) ProbePeers(ctx context.Context) {
+	for _, entry := range p.conf.StaticPeers() {
+		_, e := p.AddPeer(ctx, entry)
+		if e != nil {
+			log.Println(entry, e)
+		}
+	}
+}
+
+// refresh resolves the hostname of dev again, the last address is kept
+// when the lookup fails.
+func refresh(ctx context.Context, dev *Device, timeout time.Duration) {
+	if dev.Host == "" || dev.Addr == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	addr, e := resolve(ctx, dev.Host, dev.Addr.Port())
+	if e != nil {
+		log.Println(dev.Host, e)
+		return
+	}
+	dev.Addr = &addr
+	Records.UpdateDevice(dev.ID, func(d *Device) {
+		d.Addr = &addr
+	})
+}
@@ -0,0 +1,119 @@
+package connection
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/julioguillermo/jg_sender/config"
+)
+
+const (
+	// PresenceInterval is how often the devices that didn't announce
+	// themselves are pinged.
+	PresenceInterval = 10 * time.Second
+	// PresenceTimeout is how long a device is trusted to be online
+	// without news, three missed beacons.
+	PresenceTimeout = 3 * BeaconInterval
+)
+
+// Presence keeps Device.Online current until ctx is done. Devices on
+// the LAN refresh themselves with their beacons, the others are pinged
+// with NAME and marked offline when they don't answer.
+func (p *Server) Presence(ctx context.Context) {
+	ticker := time.NewTicker(PresenceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.checkPresence(ctx)
+		}
+	}
+}
+
+func (p *Server) checkPresence(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, dev := range Records.Stale(PresenceTimeout) {
+		dev := dev
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.ping(ctx, &dev)
+		}()
+	}
+	wg.Wait()
+}
+
+// relocating are the devices whose new address is being checked.
+var relocating = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: map[string]bool{}}
+
+// announced takes a device found by discovery. A known device only
+// moves to another address once it proved there over TLS that it is
+// the pinned one, announcements can be replayed.
+func announced(ctx context.Context, conf *config.Config, dev *Device) {
+	known := Records.Device(dev.ID)
+	if known == nil || known.Addr == nil || *known.Addr == *dev.Addr {
+		Records.SeenDevice(dev)
+		return
+	}
+	relocating.Lock()
+	busy := relocating.ids[dev.ID]
+	relocating.ids[dev.ID] = true
+	relocating.Unlock()
+	if busy {
+		return
+	}
+	go func() {
+		defer func() {
+			relocating.Lock()
+			delete(relocating.ids, dev.ID)
+			relocating.Unlock()
+		}()
+		found, e := queryName(ctx, conf, *dev.Addr, conf.ConnectTimeout(), conf.IdleTimeout())
+		if e != nil {
+			log.Println(dev.Addr, e)
+			return
+		}
+		if found.ID != dev.ID {
+			log.Println(dev.Addr, "is", found.ID, "not", dev.ID)
+			return
+		}
+		Records.SeenDevice(found)
+	}()
+}
+
+// ping asks dev for its name, another device answering at its address
+// is kept too.
+func (p *Server) ping(ctx context.Context, dev *Device) {
+	refresh(ctx, dev, p.conf.ConnectTimeout())
+	found, e := queryName(ctx, p.conf, *dev.Addr, p.conf.ConnectTimeout(), p.conf.IdleTimeout())
+	if e != nil {
+		Records.SetOffline(dev.ID)
+		return
+	}
+	if found.ID != dev.ID {
+		log.Println(dev.Addr, "now is", found.ID)
+		Records.SetOffline(dev.ID)
+	}
+	Records.SeenDevice(found)
+}
+
+// Goodbye tells the LAN this device is shutting down, it must be called
+// before the context of the server is done.
+func (p *Server) Goodbye() {
+	if p.Beacon != nil {
+		e := p.Beacon.Goodbye()
+		if e != nil {
+			log.Println("beacon", e)
+		}
+	}
+	if p.MDNS != nil {
+		p.MDNS.Goodbye()
+	}
+}
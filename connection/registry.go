@@ -0,0 +1,390 @@
+package connection
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrTransferID is a transfer ID already taken by another device, or by
+// a transfer in the other direction.
+var ErrTransferID = errors.New("transfer ID already in use")
+
+type EventKind int
+
+// Changes published by the Registry.
+const (
+	DeviceAdded EventKind = iota
+	DeviceChanged
+	DevicesInvalidated
+	TransferAdded
+	TransferChanged
+	TransfersViewed
+)
+
+// Event tells which device (UserID) or transfer (TransID) changed.
+type Event struct {
+	Kind    EventKind
+	UserID  string
+	TransID string
+}
+
+// Registry holds the known devices and the transfer history. It's safe
+// for concurrent use, readers get copies of the devices and transfers,
+// every change goes through its methods under the lock and subscribers
+// are told about it.
+type Registry struct {
+	mu        sync.RWMutex
+	devices   map[string]*Device
+	order     []string
+	transfers map[string]*Transfer
+	history   []*Transfer
+
+	subMu  sync.Mutex
+	subs   map[int]func(Event)
+	nextID int
+}
+
+var Records = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		devices:   map[string]*Device{},
+		transfers: map[string]*Transfer{},
+		subs:      map[int]func(Event){},
+	}
+}
+
+// Subscribe calls fn on every change until the returned function is
+// called. fn runs on the goroutine making the change, it must not
+// block.
+func (p *Registry) Subscribe(fn func(Event)) func() {
+	p.subMu.Lock()
+	defer p.subMu.Unlock()
+	id := p.nextID
+	p.nextID++
+	p.subs[id] = fn
+	return func() {
+		p.subMu.Lock()
+		defer p.subMu.Unlock()
+		delete(p.subs, id)
+	}
+}
+
+func (p *Registry) publish(e Event) {
+	p.subMu.Lock()
+	subs := make([]func(Event), 0, len(p.subs))
+	for _, fn := range p.subs {
+		subs = append(subs, fn)
+	}
+	p.subMu.Unlock()
+	for _, fn := range subs {
+		fn(e)
+	}
+}
+
+// Load replaces the whole content, used when restoring saved state.
+func (p *Registry) Load(history []*Transfer, devices []*Device) {
+	p.mu.Lock()
+	p.devices = map[string]*Device{}
+	p.order = p.order[:0]
+	for _, d := range devices {
+		if _, ok := p.devices[d.ID]; !ok {
+			p.order = append(p.order, d.ID)
+		}
+		p.devices[d.ID] = d
+	}
+	p.transfers = map[string]*Transfer{}
+	p.history = p.history[:0]
+	for _, t := range history {
+		if _, ok := p.transfers[t.ID]; !ok {
+			p.history = append(p.history, t)
+		}
+		p.transfers[t.ID] = t
+	}
+	p.mu.Unlock()
+	p.publish(Event{Kind: DevicesInvalidated})
+}
+
+// Snapshot copies the history and the devices at once, to save them.
+func (p *Registry) Snapshot() (history []*Transfer, devices []*Device) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	history = make([]*Transfer, len(p.history))
+	for i, t := range p.history {
+		history[i] = t.clone()
+	}
+	devices = make([]*Device, len(p.order))
+	for i, id := range p.order {
+		devices[i] = p.devices[id].clone()
+	}
+	return
+}
+
+// Devices ######################################
+
+// Devices returns the known devices, the most recently seen first.
+func (p *Registry) Devices() []*Device {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	devices := make([]*Device, len(p.order))
+	for i, id := range p.order {
+		devices[i] = p.devices[id].clone()
+	}
+	return devices
+}
+
+func (p *Registry) Device(id string) *Device {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	d, ok := p.devices[id]
+	if !ok {
+		return nil
+	}
+	return d.clone()
+}
+
+// SetDevice stores d as online and moves it to the top, the unread
+// count and the book of a known device are kept. The registry owns d
+// from then on.
+func (p *Registry) SetDevice(d *Device) {
+	p.mu.Lock()
+	kind := DeviceAdded
+	if old, ok := p.devices[d.ID]; ok {
+		kind = DeviceChanged
+		d.Not = old.Not
+		if d.Host == "" {
+			d.Host = old.Host
+		}
+		d.Alias = old.Alias
+		d.Favorite = old.Favorite
+		d.Names = old.Names
+		d.Addrs = old.Addrs
+		d.FirstSeen = old.FirstSeen
+		for i, id := range p.order {
+			if id == d.ID {
+				p.order = append(p.order[:i], p.order[i+1:]...)
+				break
+			}
+		}
+	}
+	d.Online = true
+	d.remember(d.Name, d.Addr)
+	p.devices[d.ID] = d
+	p.order = append([]string{d.ID}, p.order...)
+	p.mu.Unlock()
+	p.publish(Event{Kind: kind, UserID: d.ID})
+}
+
+// SeenDevice marks d online, a known device is updated in place and
+// keeps its position. The registry owns d from then on.
+func (p *Registry) SeenDevice(d *Device) {
+	p.mu.Lock()
+	kind := DeviceChanged
+	old, ok := p.devices[d.ID]
+	if ok {
+		old.Addr = d.Addr
+		old.Name = d.Name
+		old.OS = d.OS
+		old.Online = true
+		old.remember(d.Name, d.Addr)
+	} else {
+		kind = DeviceAdded
+		d.Online = true
+		d.remember(d.Name, d.Addr)
+		p.devices[d.ID] = d
+		p.order = append([]string{d.ID}, p.order...)
+	}
+	p.mu.Unlock()
+	p.publish(Event{Kind: kind, UserID: d.ID})
+}
+
+// UpdateDevice runs fn on the device id, if known, under the lock.
+func (p *Registry) UpdateDevice(id string, fn func(*Device)) {
+	p.mu.Lock()
+	d, ok := p.devices[id]
+	if ok {
+		fn(d)
+	}
+	p.mu.Unlock()
+	if ok {
+		p.publish(Event{Kind: DeviceChanged, UserID: id})
+	}
+}
+
+// Stale returns copies of the devices with an address that weren't seen
+// for age.
+func (p *Registry) Stale(age time.Duration) []Device {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	devices := []Device{}
+	for _, id := range p.order {
+		d := p.devices[id]
+		if d.Addr != nil && time.Since(d.LastSeen) >= age {
+			devices = append(devices, *d)
+		}
+	}
+	return devices
+}
+
+// SetOffline marks the device id offline, e.g. after its goodbye.
+func (p *Registry) SetOffline(id string) {
+	p.mu.Lock()
+	d, ok := p.devices[id]
+	changed := ok && d.Online
+	if changed {
+		d.Online = false
+	}
+	p.mu.Unlock()
+	if changed {
+		p.publish(Event{Kind: DeviceChanged, UserID: id})
+	}
+}
+
+// Favorites returns the known devices, the favorites first and then the
+// others, each group the most recently seen first.
+func (p *Registry) Favorites() []*Device {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	devices := make([]*Device, 0, len(p.order))
+	for _, id := range p.order {
+		if p.devices[id].Favorite {
+			devices = append(devices, p.devices[id].clone())
+		}
+	}
+	for _, id := range p.order {
+		if !p.devices[id].Favorite {
+			devices = append(devices, p.devices[id].clone())
+		}
+	}
+	return devices
+}
+
+// InvalidateDevices marks every device offline before a new scan, they
+// stay in the book.
+func (p *Registry) InvalidateDevices() {
+	p.mu.Lock()
+	for _, d := range p.devices {
+		d.Online = false
+	}
+	p.mu.Unlock()
+	p.publish(Event{Kind: DevicesInvalidated})
+}
+
+// History ######################################
+
+// History returns the transfers with userID in arrival order.
+func (p *Registry) History(userID string) []*Transfer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	his := []*Transfer{}
+	for _, t := range p.history {
+		if t.UserID == userID {
+			his = append(his, t.clone())
+		}
+	}
+	return his
+}
+
+// AllHistory returns every transfer in arrival order.
+func (p *Registry) AllHistory() []*Transfer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	his := make([]*Transfer, len(p.history))
+	for i, t := range p.history {
+		his[i] = t.clone()
+	}
+	return his
+}
+
+func (p *Registry) Transfer(id string) *Transfer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	t, ok := p.transfers[id]
+	if !ok {
+		return nil
+	}
+	return t.clone()
+}
+
+// live is the transfer id itself, for the one running it. Its fields
+// change with Update.
+func (p *Registry) live(id string) *Transfer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.transfers[id]
+}
+
+// SetTransfer adds t, or replaces the transfer with the same ID keeping
+// its place in the history. Peers pick the IDs, one of another device
+// or direction is refused. The registry owns t from then on, it
+// changes with Update.
+func (p *Registry) SetTransfer(t *Transfer) error {
+	p.mu.Lock()
+	kind := TransferAdded
+	if old, ok := p.transfers[t.ID]; ok {
+		if old.UserID != t.UserID || old.In != t.In {
+			p.mu.Unlock()
+			return ErrTransferID
+		}
+		kind = TransferChanged
+		for i, old := range p.history {
+			if old.ID == t.ID {
+				p.history[i] = t
+				break
+			}
+		}
+	} else {
+		p.history = append(p.history, t)
+	}
+	p.transfers[t.ID] = t
+	p.mu.Unlock()
+	p.publish(Event{Kind: kind, UserID: t.UserID, TransID: t.ID})
+	return nil
+}
+
+// Changed tells the subscribers that t made progress or finished.
+func (p *Registry) Changed(t *Transfer) {
+	p.publish(Event{Kind: TransferChanged, UserID: t.UserID, TransID: t.ID})
+}
+
+// Update runs fn, which changes t, under the lock. Changed tells the
+// subscribers, callers making progress do it less often.
+func (p *Registry) Update(t *Transfer, fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn()
+}
+
+// Canceled tells if the user canceled the file transfer t.
+func (p *Registry) Canceled(t *Transfer) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return t.File != nil && t.File.Canceled
+}
+
+// Cancel stops the file transfer id, its streams see it and end.
+func (p *Registry) Cancel(id string) {
+	p.mu.Lock()
+	t, ok := p.transfers[id]
+	ok = ok && t.File != nil && !t.File.Canceled
+	if ok {
+		t.File.Canceled = true
+	}
+	p.mu.Unlock()
+	if ok {
+		p.Changed(t)
+	}
+}
+
+// ViewAll marks the transfers with userID as seen by the peer.
+func (p *Registry) ViewAll(userID string) {
+	p.mu.Lock()
+	for _, t := range p.history {
+		if t.UserID == userID {
+			t.View = true
+		}
+	}
+	p.mu.Unlock()
+	p.publish(Event{Kind: TransfersViewed, UserID: userID})
+}
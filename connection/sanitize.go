@@ -0,0 +1,134 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var ErrUnsafeName = errors.New("unsafe file name")
+
+// Device names Windows reserves in every directory, with or without an
+// extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+func unsafeName(name, reason string) error {
+	return fmt.Errorf("%w: %q %s", ErrUnsafeName, name, reason)
+}
+
+// windowsSegment maps a path segment to one Windows can create.
+func windowsSegment(seg string) string {
+	seg = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, seg)
+	seg = strings.TrimRight(seg, ". ")
+	base := seg
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if windowsReserved[strings.ToUpper(strings.TrimSpace(base))] {
+		seg = "_" + seg
+	}
+	return seg
+}
+
+// SanitizeName turns the relative name sent by a peer into a clean
+// slash separated path for the local OS. Absolute paths and ".."
+// segments are refused, control characters dropped and the name is
+// normalized to NFC.
+func SanitizeName(name string) (string, error) {
+	clean := strings.ToValidUTF8(name, string(utf8.RuneError))
+	clean = norm.NFC.String(clean)
+	clean = strings.ReplaceAll(clean, `\`, "/")
+	if strings.HasPrefix(clean, "/") || filepath.VolumeName(clean) != "" ||
+		(len(clean) > 1 && clean[1] == ':') {
+		return "", unsafeName(name, "is absolute")
+	}
+
+	segs := []string{}
+	for _, seg := range strings.Split(clean, "/") {
+		seg = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, seg)
+		if seg == "" || seg == "." {
+			continue
+		}
+		if seg == ".." {
+			return "", unsafeName(name, "leaves the inbox")
+		}
+		if runtime.GOOS == "windows" {
+			seg = windowsSegment(seg)
+			if seg == "" {
+				seg = "_"
+			}
+		}
+		segs = append(segs, seg)
+	}
+	if len(segs) == 0 {
+		return "", unsafeName(name, "is empty")
+	}
+	return path.Join(segs...), nil
+}
+
+// InboxPath sanitizes name and joins it to inbox, refusing anything that
+// still resolves outside of it.
+func InboxPath(inbox, name string) (string, error) {
+	clean, err := SanitizeName(name)
+	if err != nil {
+		return "", err
+	}
+	dest := path.Join(inbox, clean)
+
+	root, err := filepath.Abs(inbox)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(dest)
+	if err != nil {
+		return "", err
+	}
+	if !within(root, abs) {
+		return "", unsafeName(name, "leaves the inbox")
+	}
+
+	// Symlinks already in the inbox must not lead out of it either
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return dest, nil
+	}
+	dir := filepath.Dir(abs)
+	for dir != root && !FileExist(dir) {
+		dir = filepath.Dir(dir)
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil || (realDir != realRoot && !within(realRoot, realDir)) {
+		return "", unsafeName(name, "leaves the inbox")
+	}
+	return dest, nil
+}
+
+// within reports if p is strictly inside root, both absolute.
+func within(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != "." && rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
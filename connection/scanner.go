@@ -1,147 +1,218 @@
 package connection
 
 import (
-	"math"
-	"net"
+	"context"
+	"log"
 	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/julioguillermo/jg_sender/config"
 )
 
+// SubnetProgress tells how many addresses of Subnet were scanned.
+type SubnetProgress struct {
+	Subnet netip.Prefix
+	Done   uint64
+	Total  uint64
+}
+
 type Scanner struct {
 	conf     *config.Config
-	Running  bool
-	Progress func(float64)
-	Found    func()
+	Progress func(SubnetProgress)
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
 func NewScanner(conf *config.Config) *Scanner {
 	return &Scanner{
-		conf:     conf,
-		Running:  false,
-		Progress: nil,
-		Found:    nil,
+		conf: conf,
 	}
 }
 
-func (p *Scanner) Stop() {
-	p.Running = false
+func (p *Scanner) Running() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done == nil {
+		return false
+	}
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
 }
 
-func (p *Scanner) ScannAll(subnets []*netip.Prefix) {
-	if len(subnets) == 0 {
-		p.Running = false
-		if p.Progress != nil {
-			p.Progress(-1)
-		}
+// Stop cancels the running scan and returns once every worker exited.
+func (p *Scanner) Stop() {
+	p.mu.Lock()
+	cancel, done := p.cancel, p.done
+	p.mu.Unlock()
+	if cancel == nil {
 		return
 	}
-	p.Running = true
-	maxAddr := 0.0
-	addrPro := 0.0
-	for _, sn := range subnets {
-		maxAddr += math.Pow(2, float64(32-sn.Bits()))
-	}
+	cancel()
+	<-done
+}
 
-	addrPro = 0
-	ctl := make(chan bool, p.conf.Connections())
-	end := make(chan bool)
-	for _, sn := range subnets {
-		if p.Running {
-			addr := sn.Masked().Addr()
-			for p.Running && sn.Contains(addr) {
-				ctl <- true
-				a := netip.AddrFrom4(addr.As4())
-				if addrPro < maxAddr-1 {
-					go p.scanAddr(&a, ctl, nil)
-				} else {
-					go p.scanAddr(&a, ctl, end)
-				}
-				addr = addr.Next()
-				addrPro++
-				if p.Progress != nil {
-					p.Progress(addrPro / maxAddr)
-				}
-			}
-		}
-	}
+// ScannAll scans subnets with a pool of conf.Connections() workers,
+// stopping the previous scan first. The devices are delivered on the
+// returned channel as they answer, it's closed when the scan ends.
+func (p *Scanner) ScannAll(ctx context.Context, subnets []*netip.Prefix) <-chan *Device {
+	p.Stop()
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	results := make(chan *Device)
+	p.mu.Lock()
+	p.cancel = cancel
+	p.done = done
+	p.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		defer cancel()
+		p.scan(ctx, subnets, results)
+		close(results)
+	}()
+	return results
+}
 
-	<-end
-	close(ctl)
-	close(end)
-	p.Running = false
-	if p.Progress != nil {
-		p.Progress(-1)
-	}
+type subnetCounter struct {
+	subnet netip.Prefix
+	done   uint64
+	total  uint64
 }
 
-func (p *Scanner) scanAddr(a *netip.Addr, c chan bool, e chan bool) {
-	addrPort := netip.AddrPortFrom(*a, uint16(config.Port))
-	ctl, uuid, name, dtype := p.scanAddrPort(&addrPort)
-
-	if ctl {
-		SetDevice(uuid, &Device{
-			ID:   uuid,
-			Addr: a,
-			Name: name,
-			OS:   dtype,
-		})
-		if p.Found != nil {
-			p.Found()
-		}
-	}
+type scanJob struct {
+	addr    netip.Addr
+	counter *subnetCounter
+}
 
-	if e != nil {
-		e <- true
+// SweepMaxBits is the most host bits of an IPv6 subnet swept address by
+// address, larger ones are scanned from the neighbor cache.
+const SweepMaxBits = 16
+
+func sweepable(sn netip.Prefix) bool {
+	return sn.Addr().Is4() || sn.Addr().BitLen()-sn.Bits() <= SweepMaxBits
+}
+
+func subnetSize(sn netip.Prefix) uint64 {
+	bits := sn.Addr().BitLen() - sn.Bits()
+	if bits >= 64 {
+		return ^uint64(0)
 	}
-	<-c
+	return uint64(1) << bits
 }
 
-func (p *Scanner) scanAddrPort(addr *netip.AddrPort) (bool, string, string, string) {
-	conn, err := net.DialTimeout("tcp", addr.String(), time.Duration(p.conf.Timeout())*time.Millisecond)
-	if err == nil {
-		defer conn.Close()
-		_, err = conn.Write([]byte{NAME})
-		if err != nil {
-			return false, "", "", ""
+func (p *Scanner) scan(ctx context.Context, subnets []*netip.Prefix, results chan<- *Device) {
+	jobs := make(chan scanJob)
+	workers := int(p.conf.Connections())
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.worker(ctx, jobs, results)
+		}()
+	}
+
+	defer wg.Wait()
+	defer close(jobs)
+	send := func(addr netip.Addr, counter *subnetCounter) bool {
+		select {
+		case jobs <- scanJob{addr, counter}:
+			return true
+		case <-ctx.Done():
+			return false
 		}
+	}
 
-		bint := make([]byte, 8)
-		_, err = conn.Read(bint)
-		if err != nil {
-			return false, "", "", ""
+	var neighbors []netip.Addr
+	for _, sn := range subnets {
+		counter := &subnetCounter{
+			subnet: sn.Masked(),
 		}
-		uuid_buf := make([]byte, BytesToInt(bint))
-		_, e := conn.Read(uuid_buf)
-		if e != nil {
-			return false, "", "", ""
+		if sweepable(*sn) {
+			counter.total = subnetSize(*sn)
+			for addr := counter.subnet.Addr(); counter.subnet.Contains(addr); addr = addr.Next() {
+				if !send(addr, counter) {
+					return
+				}
+			}
+			continue
 		}
-		uuid := string(uuid_buf)
 
-		_, err = conn.Read(bint)
-		if err != nil {
-			return false, "", "", ""
+		if neighbors == nil {
+			neighbors = p.neighbors(ctx)
+		}
+		addrs := []netip.Addr{}
+		for _, addr := range neighbors {
+			if counter.subnet.Contains(addr.WithZone("")) {
+				addrs = append(addrs, addr)
+			}
 		}
-		name_buf := make([]byte, BytesToInt(bint))
-		_, e = conn.Read(name_buf)
-		if e != nil {
-			return false, "", "", ""
+		counter.total = uint64(len(addrs))
+		for _, addr := range addrs {
+			if !send(addr, counter) {
+				return
+			}
 		}
-		name := string(name_buf)
+	}
+}
+
+// neighbors probes the links so the devices show up in the IPv6
+// neighbor cache, then reads it.
+func (p *Scanner) neighbors(ctx context.Context) []netip.Addr {
+	e := ProbeLink(p.conf.UUID)
+	if e != nil {
+		log.Println("scanner", e)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Duration(p.conf.Timeout()) * time.Millisecond):
+	}
+	addrs, e := Neighbors()
+	if e != nil {
+		log.Println("scanner", e)
+		return []netip.Addr{}
+	}
+	return addrs
+}
 
-		_, err = conn.Read(bint)
-		if err != nil {
-			return false, "", "", ""
+func (p *Scanner) worker(ctx context.Context, jobs <-chan scanJob, results chan<- *Device) {
+	for job := range jobs {
+		dev := p.scanAddr(ctx, job.addr)
+		if dev != nil {
+			select {
+			case results <- dev:
+			case <-ctx.Done():
+			}
 		}
-		os_buf := make([]byte, BytesToInt(bint))
-		_, e = conn.Read(os_buf)
-		if e != nil {
-			return false, "", "", ""
+		done := atomic.AddUint64(&job.counter.done, 1)
+		if p.Progress != nil {
+			p.Progress(SubnetProgress{
+				Subnet: job.counter.subnet,
+				Done:   done,
+				Total:  job.counter.total,
+			})
 		}
-		os := string(os_buf)
+	}
+}
 
-		return true, uuid, name, os
+func (p *Scanner) scanAddr(ctx context.Context, a netip.Addr) *Device {
+	// Devices on another port are found by the beacon and mDNS
+	addrPort := netip.AddrPortFrom(a, uint16(p.conf.ListenPort()))
+	timeout := time.Duration(p.conf.Timeout()) * time.Millisecond
+	dev, err := queryName(ctx, p.conf, addrPort, timeout, timeout)
+	if err != nil {
+		return nil
 	}
-	return false, "", "", ""
+	return dev
 }
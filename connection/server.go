@@ -1,63 +1,229 @@
 package connection
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
 	"net"
 	"net/netip"
+	"sync"
+	"time"
 
 	"github.com/julioguillermo/jg_sender/config"
 )
 
 var Serv *Server
 
+var (
+	ErrDeclined    = errors.New("declined")
+	ErrNoDiscovery = errors.New("discovery not available")
+)
+
 type Server struct {
-	conf          *config.Config
-	Serv          net.Listener
-	UpdateHistory func(UserID string)
-	Notify        func(UserID, title, txt string)
+	ctx    context.Context
+	conf   *config.Config
+	Serv   net.Listener
+	Notify func(UserID, title, txt string)
+
+	// Port is the one the server got, peers learn it from the user
+	// header, NAME and discovery.
+	Port uint16
+
+	// Warning is why the configured address or interface couldn't be
+	// used, the server listens on every address then.
+	Warning error
+
+	// Beacon and MDNS are nil when they couldn't start, only the TCP
+	// sweep finds devices then.
+	Beacon *Beacon
+	MDNS   *MDNS
+
+	// Pairing: ShowPairCode displays the code on this device, PairCode
+	// asks the user for the code shown by the peer.
+	ShowPairCode func(UserID, name, code string)
+	PairCode     func(UserID string) (string, bool)
+	PairResult   func(UserID string, e error)
+
+	// AcceptTransfer asks the user for an incoming transfer, it
+	// returns the folder to save the files to and, for a delta
+	// transfer, whether they replace the copies of the same name. It
+	// declines when ctx is done. Without it every transfer is accepted
+	// to the inbox as new copies.
+	AcceptTransfer func(ctx context.Context, UserID, name string, files []*Element, total uint64, delta bool) (dir string, replace, ok bool)
+
+	// Transfers being received, more streams join them by ID
+	inMu     sync.Mutex
+	incoming map[string]*incoming
+
+	// When each address last asked to pair
+	pairMu sync.Mutex
+	pairs  map[netip.Addr]time.Time
 }
 
-func InitServer(conf *config.Config) *Server {
-	server, err := net.Listen("tcp", "0.0.0.0:"+fmt.Sprint(config.Port))
+// ListenFallback is how many ports after the configured one are tried
+// before letting the system pick a free one.
+const ListenFallback = 10
+
+// ApprovalTimeout is how long the user has to accept a transfer, it is
+// declined after that, and the peer's user to type a pairing code.
+const ApprovalTimeout = 5 * time.Minute
+
+// InitServer starts listening and discovery, ctx stops the server and
+// every connection it handles. Connections are handled once
+// ProcessServer runs, after the callbacks are set.
+func InitServer(ctx context.Context, conf *config.Config) (*Server, error) {
+	Store = LoadStore(conf.AppDir())
+	err := InitTLS(conf.AppDir())
 	if err != nil {
-		fmt.Println(err)
-		return nil
+		return nil, err
+	}
+	host, warning := listenHost(conf)
+	if warning != nil {
+		warning = fmt.Errorf("listening on every address: %w", warning)
+		log.Println(warning)
+		host = ""
+	}
+	server, err := listen(host, conf.ListenPort())
+	if err != nil {
+		return nil, err
 	}
 	Serv = &Server{
-		conf: conf,
-		Serv: server,
+		ctx:     ctx,
+		conf:    conf,
+		Serv:    server,
+		Port:    uint16(server.Addr().(*net.TCPAddr).Port),
+		Warning: warning,
+	}
+	Serv.Beacon, err = StartBeacon(ctx, conf, Serv.Port)
+	if err != nil {
+		log.Println(err)
+	}
+	Serv.MDNS, err = StartMDNS(ctx, conf, Serv.Port)
+	if err != nil {
+		log.Println(err)
+	}
+	go Serv.ProbePeers(ctx)
+	go Serv.Presence(ctx)
+	return Serv, nil
+}
+
+// listen binds host and port, falling back to the following ports and
+// then to any free one. An empty host is every address.
+func listen(host string, port uint64) (net.Listener, error) {
+	for i := uint64(0); i <= ListenFallback && port+i <= 0xffff; i++ {
+		server, err := net.Listen("tcp", net.JoinHostPort(host, fmt.Sprint(port+i)))
+		if err == nil {
+			return server, nil
+		}
+		log.Println(err)
+	}
+	return net.Listen("tcp", net.JoinHostPort(host, "0"))
+}
+
+// advertised returns the addresses the server can be reached at.
+func advertised(conf *config.Config) []netip.Addr {
+	addrs := []netip.Addr{}
+	host, err := listenHost(conf)
+	if err == nil && host != "" {
+		ip, err := netip.ParseAddr(host)
+		if err == nil {
+			return append(addrs, ip.WithZone(""))
+		}
+	}
+	for _, sn := range GetIPS() {
+		addrs = append(addrs, sn.Addr())
+	}
+	return addrs
+}
+
+// listenHost returns the configured address, or the first one of the
+// configured interface. Empty means every address.
+func listenHost(conf *config.Config) (string, error) {
+	name := conf.ListenInterface()
+	if addr := conf.ListenAddr(); addr != "" {
+		ip, err := netip.ParseAddr(addr)
+		if err != nil {
+			return "", err
+		}
+		if ip.Is6() && ip.IsLinkLocalUnicast() && ip.Zone() == "" {
+			ip = ip.WithZone(name)
+		}
+		return ip.String(), nil
+	}
+	if name == "" {
+		return "", nil
+	}
+
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return "", err
+	}
+	// Link-local addresses only when there is nothing else
+	var local netip.Addr
+	for _, a := range addrs {
+		pre, err := netip.ParsePrefix(a.String())
+		if err != nil {
+			continue
+		}
+		ip := pre.Addr()
+		if !ip.IsLinkLocalUnicast() {
+			return ip.String(), nil
+		}
+		if !local.IsValid() {
+			local = ip.WithZone(name)
+		}
 	}
-	go Serv.ProcessServer()
-	return Serv
+	if local.IsValid() {
+		return local.String(), nil
+	}
+	return "", fmt.Errorf("interface %s has no address", name)
 }
 
+// ProcessServer handles the connections until ctx is done, the callbacks
+// must not change while it runs.
 func (p *Server) ProcessServer() {
+	go func() {
+		<-p.ctx.Done()
+		p.Serv.Close()
+	}()
 	for {
-		connection, err := p.Serv.Accept()
-		if err == nil {
-			go p.ProcessClient(connection)
+		conn, err := p.Serv.Accept()
+		if err != nil {
+			if p.ctx.Err() != nil {
+				return
+			}
+			continue
 		}
+		timed := newTimedConn(conn, p.conf.IdleTimeout())
+		go p.ProcessClient(tls.Server(timed, serverTLS))
 	}
 }
 
-func (p *Server) ProcessClient(connection net.Conn) {
+func (p *Server) ProcessClient(conn net.Conn) {
+	defer conn.Close()
+	connection, e := AcceptHandshake(conn)
+	if e != nil {
+		log.Println(conn.RemoteAddr(), e)
+		return
+	}
+	connection.Bind(p.ctx)
 	defer connection.Close()
-	ctl := make([]byte, 1)
-	_, e := connection.Read(ctl)
-	if e != nil || len(ctl) == 0 {
+	ctl, e := connection.ReadByte()
+	if e != nil {
 		return
 	}
-	switch ctl[0] {
+	if !connection.Supports(commandFeature(ctl)) {
+		return
+	}
+	switch ctl {
 	case NAME:
-		uuid := p.conf.UUID
-		name := p.conf.Name()
-		os := p.conf.OS()
-		connection.Write(IntToBytes(uint64(len(uuid))))
-		connection.Write([]byte(uuid))
-		connection.Write(IntToBytes(uint64(len(name))))
-		connection.Write([]byte(name))
-		connection.Write(IntToBytes(uint64(len(os))))
-		connection.Write([]byte(os))
+		p.SendName(connection)
 	case MSG:
 		p.GetMSG(connection)
 	case RESOURCES:
@@ -66,65 +232,150 @@ func (p *Server) ProcessClient(connection net.Conn) {
 		p.ContinueSendingTrans(connection)
 	case USER_VIEW:
 		p.UserView(connection)
+	case PAIR:
+		p.GetPair(connection)
+	case STREAM:
+		p.GetStream(connection)
 	}
 }
 
-func (p *Server) ContinueTrans(userID string, trans *Transfer) {
-	trans.Error = nil
-	trans.File.Canceled = false
-	p.UpdateHistory(userID)
-	if trans.In {
-		p.ContinueRecivingTrans(userID, trans)
-	} else {
-		p.SendTrans(userID, trans)
+// Probe asks the devices on the LAN to announce themselves and probes
+// the static peers, it fails when no discovery method could.
+func (p *Server) Probe() error {
+	go p.ProbePeers(p.ctx)
+	err := ErrNoDiscovery
+	if p.Beacon != nil {
+		e := p.Beacon.Probe()
+		if e == nil {
+			err = nil
+		} else {
+			log.Println("beacon", e)
+		}
 	}
+	if p.MDNS != nil {
+		e := p.MDNS.Browse()
+		if e == nil {
+			err = nil
+		} else {
+			log.Println("mdns", e)
+		}
+	}
+	return err
 }
 
-func (p *Server) UserView(connection net.Conn) {
-	bint := make([]byte, 8)
-
-	// User ID
-	_, e := connection.Read(bint)
+// dial connects to dev and refuses peers whose certificate doesn't
+// match the pinned one.
+func (p *Server) dial(ctx context.Context, dev *Device) (*Session, error) {
+	refresh(ctx, dev, p.conf.ConnectTimeout())
+	if dev.Addr == nil {
+		return nil, errors.New("unknown address")
+	}
+	// On first contact the peer proves its key with NAME before its
+	// certificate is pinned
+	if !Pins.Known(dev.ID) {
+		found, e := queryName(ctx, p.conf, *dev.Addr, p.conf.ConnectTimeout(), p.conf.IdleTimeout())
+		if e != nil {
+			return nil, e
+		}
+		if found.ID != dev.ID {
+			return nil, fmt.Errorf("%w: %s answers at %s", ErrUnverified, found.ID, dev.Addr)
+		}
+	}
+	connection, e := Connect(ctx, *dev.Addr, p.conf.ConnectTimeout(), p.conf.IdleTimeout())
 	if e != nil {
-		return
+		return nil, e
 	}
-	buserID := make([]byte, BytesToInt(bint))
-	_, e = connection.Read(buserID)
+	e = connection.Pin(dev.ID)
 	if e != nil {
-		return
+		warning := e.Error()
+		Records.UpdateDevice(dev.ID, func(dev *Device) {
+			dev.Warning = warning
+		})
+		connection.Close()
+		return nil, e
 	}
-	UserID := string(buserID)
+	return connection, nil
+}
 
-	UserView(UserID)
-	if p.UpdateHistory != nil {
-		p.UpdateHistory(UserID)
+// SendName answers the NAME command with the signed identity.
+func (p *Server) SendName(connection *Session) error {
+	uuid := p.conf.UUID
+	name := p.conf.Name()
+	os := p.conf.OS()
+	port := fmt.Sprint(p.Port)
+	sig := connection.Sign(p.conf, SignName, uuid, name, os, port)
+	e := connection.WriteString(uuid)
+	if e != nil {
+		return e
 	}
+	e = connection.WriteFrame(p.conf.PublicKey())
+	if e != nil {
+		return e
+	}
+	e = connection.WriteString(name)
+	if e != nil {
+		return e
+	}
+	e = connection.WriteString(os)
+	if e != nil {
+		return e
+	}
+	e = connection.WriteUint64(uint64(p.Port))
+	if e != nil {
+		return e
+	}
+	return connection.WriteFrame(sig)
 }
 
-func (p *Server) SendUserView(userID string) {
-	dev := GetDevice(userID)
-	if dev == nil {
+// ContinueTrans resumes the file transfer transID.
+func (p *Server) ContinueTrans(ctx context.Context, userID, transID string) {
+	trans := Records.live(transID)
+	if trans == nil || trans.File == nil {
 		return
 	}
+	Records.Update(trans, func() {
+		trans.Error = nil
+		trans.File.Canceled = false
+	})
+	Records.Changed(trans)
+	if trans.In {
+		p.ContinueRecivingTrans(ctx, userID, trans)
+	} else {
+		p.SendTrans(ctx, userID, trans)
+	}
+}
 
-	addrPort := netip.AddrPortFrom(*dev.Addr, uint16(config.Port))
-	connection, e := net.Dial("tcp", addrPort.String())
+func (p *Server) UserView(connection *Session) {
+	UserID, _, _, _, e := p.GetUser(connection)
 	if e != nil {
 		return
 	}
+	if !p.accept(connection, UserID, USER_VIEW) {
+		return
+	}
+
+	Records.ViewAll(UserID)
+}
 
-	_, e = connection.Write([]byte{USER_VIEW})
+func (p *Server) SendUserView(ctx context.Context, userID string) {
+	dev := Records.Device(userID)
+	if dev == nil {
+		return
+	}
+
+	connection, e := p.dial(ctx, dev)
 	if e != nil {
 		return
 	}
+	defer connection.Close()
 
-	// User ID
-	_, e = connection.Write(IntToBytes(uint64(len(p.conf.UUID))))
+	e = connection.Command(USER_VIEW)
 	if e != nil {
 		return
 	}
-	_, e = connection.Write([]byte(p.conf.UUID))
+	e = p.SendUser(connection, "")
 	if e != nil {
 		return
 	}
+	accepted(connection)
 }
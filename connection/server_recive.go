@@ -1,85 +1,111 @@
 package connection
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"net"
+	"log"
 	"net/netip"
 	"os"
 	"path"
-	"strings"
 	"time"
-
-	"github.com/julioguillermo/jg_sender/config"
 )
 
-func (p *Server) GetUser(connection net.Conn) (userID, userName, userOS, transID string, e error) {
-	bint := make([]byte, 8)
+// userHeader is the signed identity sent before every command.
+type userHeader struct {
+	ID      string
+	Key     []byte
+	Name    string
+	OS      string
+	Port    uint16
+	TransID string
+	Sig     []byte
+}
 
-	// User ID
-	_, e = connection.Read(bint)
+func readUserHeader(codec *Codec, limits *Limits) (h userHeader, e error) {
+	h.ID, e = codec.ReadString(limits.ID)
 	if e != nil {
 		return
 	}
-	buserID := make([]byte, BytesToInt(bint))
-	_, e = connection.Read(buserID)
+	h.Key, e = codec.ReadFrame(MaxKey)
 	if e != nil {
 		return
 	}
-	userID = string(buserID)
-
-	// User name
-	_, e = connection.Read(bint)
+	h.Name, e = codec.ReadString(limits.Name)
+	if e != nil {
+		return
+	}
+	h.OS, e = codec.ReadString(MaxOS)
+	if e != nil {
+		return
+	}
+	h.Port, e = readPort(codec)
 	if e != nil {
 		return
 	}
-	buserName := make([]byte, BytesToInt(bint))
-	_, e = connection.Read(buserName)
+	h.TransID, e = codec.ReadString(limits.ID)
 	if e != nil {
 		return
 	}
-	userName = string(buserName)
+	h.Sig, e = codec.ReadFrame(MaxSig)
+	return
+}
+
+// logProtocol logs the requests refused for breaking the protocol.
+func logProtocol(connection *Session, e error) {
+	if errors.Is(e, ErrProtocol) {
+		log.Println(connection.RemoteAddr(), e)
+	}
+}
 
-	// User OS
-	_, e = connection.Read(bint)
+func (p *Server) GetUser(connection *Session) (userID, userName, userOS, transID string, e error) {
+	h, e := readUserHeader(connection.Codec, NewLimits(p.conf))
 	if e != nil {
+		logProtocol(connection, e)
 		return
 	}
-	buserOS := make([]byte, BytesToInt(bint))
-	_, e = connection.Read(buserOS)
+	userID, userName, userOS, transID = h.ID, h.Name, h.OS, h.TransID
+	e = connection.Verify(h.ID, h.Key, h.Sig, SignUser, h.ID, h.Name, h.OS, fmt.Sprint(h.Port), h.TransID)
+	if e != nil {
+		log.Println(connection.RemoteAddr(), e)
+		return
+	}
+
+	// Refuse peers presenting another certificate than the pinned one
+	e = connection.Pin(userID)
 	if e != nil {
+		warning := e.Error()
+		Records.UpdateDevice(userID, func(dev *Device) {
+			dev.Warning = warning
+		})
 		return
 	}
-	userOS = string(buserOS)
 
 	// Update users
-	addr, _ := netip.ParseAddr(strings.Split(connection.RemoteAddr().String(), ":")[0])
-	SetDevice(userID, &Device{
+	addr := netip.AddrPortFrom(remoteAddr(connection), h.Port)
+	dev := &Device{
 		ID:   userID,
 		Addr: &addr,
 		Name: userName,
 		OS:   userOS,
-	})
-
-	// Read TransID
-	_, e = connection.Read(bint)
-	if e != nil {
-		return
 	}
-	bTransID := make([]byte, BytesToInt(bint))
-	_, e = connection.Read(bTransID)
-	if e != nil {
-		return
+	Records.SetDevice(dev)
+	// The user knows the peer by its alias
+	if known := Records.Device(userID); known != nil {
+		userName = known.Title()
 	}
-	transID = string(bTransID)
 	return
 }
 
-func (p *Server) GetMSG(connection net.Conn) {
+func (p *Server) GetMSG(connection *Session) {
 	userID, userName, _, transID, e := p.GetUser(connection)
 	if e != nil {
 		return
 	}
+	if !p.accept(connection, userID, MSG) {
+		return
+	}
 	transID = "R" + transID
 
 	trans := &Transfer{
@@ -88,33 +114,31 @@ func (p *Server) GetMSG(connection net.Conn) {
 		DateTime: time.Now(),
 		In:       true,
 	}
-	SetTrans(transID, trans)
+	e = Records.SetTransfer(trans)
+	if e != nil {
+		log.Println(connection.RemoteAddr(), e)
+		return
+	}
 
-	bint := make([]byte, 8)
 	// MSG
-	_, e = connection.Read(bint)
+	msg, e := connection.ReadString(NewLimits(p.conf).MSG)
+	logProtocol(connection, e)
+	Records.Update(trans, func() {
+		trans.MSG = msg
+		trans.Error = e
+	})
 	if e == nil {
-		bmsg := make([]byte, BytesToInt(bint))
-		_, e = connection.Read(bmsg)
-		if e == nil {
-			trans.MSG = string(bmsg)
-			if p.Notify != nil {
-				p.Notify(userID, "MSG from: "+userName, string(bmsg))
-			}
-			if p.UpdateHistory != nil {
-				p.UpdateHistory(userID)
-			}
-			return
+		if p.Notify != nil {
+			p.Notify(userID, "MSG from: "+userName, msg)
 		}
+		Records.Changed(trans)
+		return
 	}
-	trans.Error = e
 
 	if p.Notify != nil {
 		p.Notify(userID, "MSG from: "+userName, e.Error())
 	}
-	if p.UpdateHistory != nil {
-		p.UpdateHistory(userID)
-	}
+	Records.Changed(trans)
 }
 
 func FileExist(p string) bool {
@@ -135,227 +159,298 @@ func CheckName(p string) string {
 	return p
 }
 
-func (p *Server) GetResources(connection net.Conn) {
-	userID, userName, _, transID, err := p.GetUser(connection)
-	if err != nil {
+// readManifest reads the header of a RESOURCES request: the chunk size,
+// the compression offered and whether it is a delta transfer when the
+// peers agreed on those features, the byte counters, the file list with
+// the files already done and the first file not done.
+func readManifest(codec *Codec, features uint64, limits *Limits) (bufSize uint64, trans *FileTransfer, e error) {
+	bufSize, e = codec.ReadUint64()
+	if e != nil {
 		return
 	}
-	transID = "R" + transID
-
-	bint := make([]byte, 8)
-	// Get bufSize
-	_, err = connection.Read(bint)
-	if err != nil {
+	if bufSize == 0 || bufSize > limits.BufSize {
+		e = overLimit("buffer size", bufSize, limits.BufSize)
 		return
 	}
-	BufSize := BytesToInt(bint)
 
-	// Get Total size
-	_, err = connection.Read(bint)
-	if err != nil {
+	trans = &FileTransfer{}
+	if features&FeatureCompress != 0 {
+		trans.Compress, e = codec.ReadUint64()
+		if e != nil {
+			return
+		}
+	}
+	if features&FeatureDelta != 0 {
+		var delta byte
+		delta, e = codec.ReadByte()
+		if e != nil {
+			return
+		}
+		trans.Delta = delta != 0
+	}
+	trans.TotalBytes, e = codec.ReadUint64()
+	if e != nil {
 		return
 	}
-	TotalBytes := BytesToInt(bint)
-	// get sended bytes
-	_, err = connection.Read(bint)
-	if err != nil {
+	trans.TransBytes, e = codec.ReadUint64()
+	if e != nil {
+		return
+	}
+	if trans.TransBytes > trans.TotalBytes {
+		e = overLimit("transferred bytes", trans.TransBytes, trans.TotalBytes)
 		return
 	}
-	TransBytes := BytesToInt(bint)
 
-	// Get files
-	_, err = connection.Read(bint)
-	if err != nil {
+	count, e := codec.ReadUint64()
+	if e != nil {
 		return
 	}
-	files_number := BytesToInt(bint)
-	files := make([]*Element, files_number)
-	//var num uint64
-	for i := range files {
-		_, err = connection.Read(bint)
-		if err != nil {
+	if count > limits.Files {
+		e = overLimit("file count", count, limits.Files)
+		return
+	}
+	trans.Files = make([]*Element, count)
+	names := uint64(0)
+	for i := range trans.Files {
+		file := &Element{}
+		file.Name, e = codec.ReadString(limits.FileName)
+		if e != nil {
 			return
 		}
-		fileName := make([]byte, BytesToInt(bint))
-		_, err = connection.Read(fileName)
-		if err != nil {
+		names += uint64(len(file.Name))
+		if names > limits.Manifest {
+			e = overLimit("file names", names, limits.Manifest)
 			return
 		}
-		// File size
-		_, err = connection.Read(bint)
-		if err != nil {
+		file.Size, e = codec.ReadUint64()
+		if e != nil {
 			return
 		}
-		size := BytesToInt(bint)
-		// File progress
-		_, err = connection.Read(bint)
-		if err != nil {
+		file.Prog, e = codec.ReadUint64()
+		if e != nil {
+			return
+		}
+		if file.Prog > file.Size {
+			e = overLimit("progress", file.Prog, file.Size)
 			return
 		}
-		prog := BytesToInt(bint)
-		files[i] = &Element{
-			Path: path.Join(p.conf.C_InboxDir, string(fileName)),
-			Name: string(fileName),
-			Size: size,
-			Prog: prog,
+		file.Hash, e = codec.ReadFrame(MaxHash)
+		if e != nil {
+			return
+		}
+		var done byte
+		done, e = codec.ReadByte()
+		if e != nil {
+			return
 		}
+		file.Done = done != 0
+		if file.Done && file.Prog != file.Size {
+			e = overLimit("size of a done file", file.Size, file.Prog)
+			return
+		}
+		trans.Files[i] = file
+	}
+
+	trans.Index, e = codec.ReadUint64()
+	if e == nil && trans.Index > count {
+		e = overLimit("file index", trans.Index, count)
+	}
+	return
+}
+
+// sameFiles tells if a resume lists the files that were accepted.
+func sameFiles(accepted, files []*Element) bool {
+	if len(accepted) != len(files) {
+		return false
+	}
+	for i, f := range files {
+		a := accepted[i]
+		if a.Name != f.Name || a.Size != f.Size || !bytes.Equal(a.Hash, f.Hash) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Server) GetResources(connection *Session) {
+	userID, userName, _, transID, err := p.GetUser(connection)
+	if err != nil {
+		return
 	}
-	// Get current files
-	_, err = connection.Read(bint)
+	if !p.accept(connection, userID, RESOURCES) {
+		return
+	}
+	transID = "R" + transID
+
+	bufSize, transFile, err := readManifest(connection.Codec, connection.Features, NewLimits(p.conf))
 	if err != nil {
+		logProtocol(connection, err)
 		return
 	}
-	files_index := BytesToInt(bint)
+	// A resumed transfer keeps the folder it was accepted to, only if
+	// it comes from the same sender with the same files
+	old := Records.Transfer(transID)
+	if old != nil && old.In && old.UserID == userID && old.File != nil && sameFiles(old.File.Files, transFile.Files) {
+		transFile.Dir = old.File.Dir
+		transFile.Replace = old.File.Replace && transFile.Delta
+	}
+	transFile.Waiting = transFile.Dir == ""
 
 	trans := &Transfer{
 		ID:       transID,
 		UserID:   userID,
 		DateTime: time.Now(),
 		In:       true,
-		File: &FileTransfer{
-			Files:      files,
-			Index:      files_index,
-			TransBytes: TransBytes,
-			TotalBytes: TotalBytes,
-			Canceled:   false,
-		},
-	}
-	SetTrans(transID, trans)
-	if p.UpdateHistory != nil {
-		defer p.UpdateHistory(userID)
+		File:     transFile,
 	}
-	if p.Notify != nil {
-		p.Notify(userID, "File from: "+userName, fmt.Sprintf("%d files", files_number))
-	}
-
-	// Recive files
-	var f *os.File
-	var dir string
-	var t int
-	buf := make([]byte, BufSize)
-	ctl := make([]byte, 1)
-	for trans.File.Index = files_index; trans.File.Index < files_number; trans.File.Index++ {
-		file := trans.File.Files[trans.File.Index]
-
-		dir = path.Dir(file.Path)
-		if dir != "." {
-			err = os.MkdirAll(dir, 0777)
-			if err != nil {
-				trans.Error = err
-				return
+	err = Records.SetTransfer(trans)
+	if err != nil {
+		log.Println(connection.RemoteAddr(), err)
+		connection.WriteByte(ERROR)
+		return
+	}
+	err = p.getResources(connection, trans, bufSize, userName)
+	Records.Update(trans, func() {
+		trans.Error = transferError(p.ctx, err)
+	})
+	Records.Changed(trans)
+}
+
+// getResources asks the user for the files of trans unless it is a
+// resume, and receives them.
+func (p *Server) getResources(connection *Session, trans *Transfer, bufSize uint64, userName string) error {
+	userID, transID, transFile := trans.UserID, trans.ID, trans.File
+	if transFile.Waiting {
+		if p.Notify != nil {
+			p.Notify(userID, "File from: "+userName, fmt.Sprintf("%d files", len(transFile.Files)))
+		}
+		Records.Changed(trans)
+		dir, replace, ok := p.conf.Inbox(), false, true
+		if p.AcceptTransfer != nil {
+			ctx, cancel := context.WithTimeout(p.ctx, ApprovalTimeout)
+			dir, replace, ok = p.AcceptTransfer(ctx, userID, userName, transFile.Files, transFile.TotalBytes, transFile.Delta)
+			cancel()
+		}
+		Records.Update(trans, func() {
+			transFile.Waiting = false
+			if ok {
+				transFile.Dir = dir
+				transFile.Replace = replace && transFile.Delta
 			}
+		})
+		if !ok {
+			connection.WriteByte(DENIED)
+			return ErrDeclined
 		}
+	}
 
-		tmp := file.Path + "_" + trans.ID + ".tmp"
-		if file.Prog == 0 {
-			//tmp = CheckName(tmp)
-			f, err = os.Create(tmp)
-			if err != nil {
-				trans.Error = err
-				return
-			}
-		} else {
-			f, err = os.OpenFile(tmp, os.O_RDWR, 0777)
-			if err != nil {
-				trans.Error = err
-				return
+	// Names come from the peer, keep them inside the chosen folder
+	for _, file := range transFile.Files {
+		dst, err := InboxPath(transFile.Dir, file.Name)
+		if err != nil {
+			log.Println(connection.RemoteAddr(), err)
+			if p.Notify != nil {
+				p.Notify(userID, "File from: "+userName, err.Error())
 			}
+			connection.WriteByte(ERROR)
+			return err
 		}
-		f.Seek(int64(file.Prog), 0)
-
-		for file.Prog < file.Size {
-			// Check if source canceled
-			_, err = connection.Read(ctl)
-			if err != nil {
-				trans.Error = err
-				f.Close()
-				return
-			}
-			if ctl[0] == CANCELED {
-				trans.File.Canceled = true
-				f.Close()
-				return
-			}
+		Records.Update(trans, func() {
+			file.Path = dst
+		})
+	}
 
-			if file.Size-file.Prog < BufSize {
-				t, err = connection.Read(buf[:file.Size-file.Prog])
-			} else {
-				t, err = connection.Read(buf)
-			}
-			if err != nil {
-				trans.Error = err
-				f.Close()
-				return
-			}
-			_, err = f.Write(buf[:t])
-			if err != nil {
-				trans.Error = err
-				f.Close()
-				return
-			}
+	// The copies a delta transfer replaces are signed before answering,
+	// the sender waits for it as long as for any answer
+	sigs := deltaSignatures(transFile, time.Now().Add(p.conf.IdleTimeout()/2))
 
-			// Send ctl to cancel or continue
-			if trans.File.Canceled {
-				_, err = connection.Write([]byte{CANCELED})
-				if err != nil {
-					trans.Error = err
-				}
-				f.Close()
-				return
-			}
-			_, err = connection.Write([]byte{OK})
-			if err != nil {
-				trans.Error = err
-				f.Close()
-				return
-			}
+	// More streams may join while this one runs
+	Records.Update(trans, func() {
+		transFile.Compress = chooseCompress(transFile.Compress, p.conf.Compress())
+	})
+	in := newIncoming(trans, bufSize)
+	p.register(transID, in)
+	defer p.unregister(transID, in)
 
-			file.Prog += uint64(t)
-			trans.File.TransBytes += uint64(t)
-			if p.UpdateHistory != nil {
-				p.UpdateHistory(userID)
-			}
+	err := connection.WriteByte(OK)
+	if err != nil {
+		return err
+	}
+	err = connection.WriteUint64(FlowWindow)
+	if err != nil {
+		return err
+	}
+	err = connection.WriteUint64(p.streams())
+	if err != nil {
+		return err
+	}
+	if connection.Supports(FeatureCompress) {
+		err = connection.WriteUint64(transFile.Compress)
+		if err != nil {
+			return err
 		}
-		f.Close()
-		os.Rename(tmp, CheckName(file.Path))
 	}
+	if transFile.Delta {
+		err = writeSignatures(connection.Codec, sigs)
+		if err != nil {
+			return err
+		}
+	}
+	connection.SetTimeout(p.conf.StallTimeout())
+
+	// Recive files, the written bytes are granted back to the sender
+	err = p.receiveStream(connection, in)
+	logProtocol(connection, err)
+	in.leave(err)
+	e := in.Wait(p.ctx)
+	in.close()
+	return e
 }
 
-func (p *Server) ContinueRecivingTrans(userID string, trans *Transfer) {
-	if p.UpdateHistory != nil {
-		defer p.UpdateHistory(userID)
-	}
-	dev := GetDevice(userID)
+func (p *Server) ContinueRecivingTrans(ctx context.Context, userID string, trans *Transfer) {
+	e := p.continueRecivingTrans(ctx, userID, trans)
+	Records.Update(trans, func() {
+		trans.Error = transferError(ctx, e)
+	})
+	Records.Changed(trans)
+}
+
+// continueRecivingTrans asks the sender of trans to send what is left,
+// the files come over a new RESOURCES connection.
+func (p *Server) continueRecivingTrans(ctx context.Context, userID string, trans *Transfer) error {
+	dev := Records.Device(userID)
 	if dev == nil {
-		trans.Error = errors.New("user not found")
-		return
+		return errors.New("user not found")
 	}
 
 	// Connecting
-	addrPort := netip.AddrPortFrom(*dev.Addr, uint16(config.Port))
-	connection, e := net.Dial("tcp", addrPort.String())
+	connection, e := p.dial(ctx, dev)
 	if e != nil {
-		trans.Error = e
-		return
+		return e
 	}
 	defer connection.Close()
 
-	// CTL MSG: RESOURCES
-	_, e = connection.Write([]byte{CONT_TRANS})
+	// CTL MSG: CONT_TRANS
+	e = connection.Command(CONT_TRANS)
 	if e != nil {
-		trans.Error = e
-		return
+		return e
 	}
 	// Send user info and trans id
 	e = p.SendUser(connection, trans.ID[1:])
 	if e != nil {
-		trans.Error = e
-		return
+		return e
 	}
 
-	ctl := make([]byte, 1)
-	connection.Read(ctl)
-	if ctl[0] == ERROR {
-		trans.Error = errors.New("can not continue")
+	ctl, e := connection.ReadByte()
+	if e != nil {
+		return e
+	}
+	switch ctl {
+	case OK:
+		return nil
+	case DENIED:
+		return ErrNotPaired
+	default:
+		return errors.New("can not continue")
 	}
 }
@@ -0,0 +1,105 @@
+package connection
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/julioguillermo/jg_sender/config"
+)
+
+// testLimits are the default limits, small enough to fuzz.
+func testLimits() *Limits {
+	return &Limits{
+		ID:       config.DefaultMaxID,
+		Name:     config.DefaultMaxName,
+		MSG:      config.DefaultMaxMSG,
+		Files:    config.DefaultMaxFiles,
+		FileName: config.DefaultMaxFileName,
+		BufSize:  config.DefaultMaxBufSize,
+		Manifest: config.DefaultMaxManifest,
+	}
+}
+
+// testConfig has a fixed identity, enough to sign.
+func testConfig() *config.Config {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	conf := &config.Config{Key: key, C_Name: "test"}
+	conf.UUID = config.DeviceID(conf.PublicKey())
+	return conf
+}
+
+func FuzzReadUserHeader(f *testing.F) {
+	var buf bytes.Buffer
+	codec := NewCodec(&buf)
+	codec.WriteString("id")
+	codec.WriteFrame(make([]byte, MaxKey))
+	codec.WriteString("name")
+	codec.WriteString("linux")
+	codec.WriteUint64(4000)
+	codec.WriteString("trans")
+	codec.WriteFrame(make([]byte, MaxSig))
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		limits := testLimits()
+		h, e := readUserHeader(NewCodec(bytes.NewBuffer(data)), limits)
+		if e != nil {
+			return
+		}
+		if uint64(len(h.ID)) > limits.ID || uint64(len(h.Name)) > limits.Name || len(h.OS) > MaxOS {
+			t.Fatalf("header over the limits: %d %d %d", len(h.ID), len(h.Name), len(h.OS))
+		}
+		if len(h.Key) > MaxKey || len(h.Sig) > MaxSig || h.Port == 0 {
+			t.Fatalf("bad key %d, signature %d or port %d", len(h.Key), len(h.Sig), h.Port)
+		}
+	})
+}
+
+func FuzzReadManifest(f *testing.F) {
+	var buf bytes.Buffer
+	codec := NewCodec(&buf)
+	codec.WriteUint64(1 << 20)
+	codec.WriteUint64(config.CompressDeflate)
+	codec.WriteByte(1)
+	codec.WriteUint64(10)
+	codec.WriteUint64(4)
+	codec.WriteUint64(2)
+	codec.WriteString("a/b.txt")
+	codec.WriteUint64(4)
+	codec.WriteUint64(4)
+	codec.WriteFrame(make([]byte, MaxHash))
+	codec.WriteByte(1)
+	codec.WriteString("c.bin")
+	codec.WriteUint64(6)
+	codec.WriteUint64(0)
+	codec.WriteFrame(make([]byte, MaxHash))
+	codec.WriteByte(0)
+	codec.WriteUint64(1)
+	f.Add(buf.Bytes(), uint64(FeatureCompress|FeatureDelta))
+	f.Add(buf.Bytes(), uint64(0))
+
+	f.Fuzz(func(t *testing.T, data []byte, features uint64) {
+		limits := testLimits()
+		bufSize, trans, e := readManifest(NewCodec(bytes.NewBuffer(data)), features, limits)
+		if e != nil {
+			return
+		}
+		if bufSize == 0 || bufSize > limits.BufSize {
+			t.Fatalf("buffer size %d", bufSize)
+		}
+		if trans.TransBytes > trans.TotalBytes || trans.Index > uint64(len(trans.Files)) {
+			t.Fatalf("counters %d of %d, index %d", trans.TransBytes, trans.TotalBytes, trans.Index)
+		}
+		names := uint64(0)
+		for _, file := range trans.Files {
+			names += uint64(len(file.Name))
+			if file.Prog > file.Size || file.Done && file.Prog != file.Size {
+				t.Fatalf("file %q at %d of %d", file.Name, file.Prog, file.Size)
+			}
+		}
+		if uint64(len(trans.Files)) > limits.Files || names > limits.Manifest {
+			t.Fatalf("%d files with %d bytes of names", len(trans.Files), names)
+		}
+	})
+}
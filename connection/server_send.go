@@ -1,67 +1,56 @@
 package connection
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io/fs"
-	"net"
-	"net/netip"
+	"log"
 	"os"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/julioguillermo/jg_sender/config"
 )
 
-func (p *Server) SendUser(connection net.Conn, transID string) error {
+func (p *Server) SendUser(connection *Session, transID string) error {
 	userID := p.conf.UUID
 	userName := p.conf.C_Name
 	userOS := p.conf.OS()
+	port := fmt.Sprint(p.Port)
+	sig := connection.Sign(p.conf, SignUser, userID, userName, userOS, port, transID)
 
-	// User ID
-	_, e := connection.Write(IntToBytes(uint64(len(userID))))
+	e := connection.WriteString(userID)
 	if e != nil {
 		return e
 	}
-	_, e = connection.Write([]byte(userID))
+	e = connection.WriteFrame(p.conf.PublicKey())
 	if e != nil {
 		return e
 	}
-
-	// User Name
-	_, e = connection.Write(IntToBytes(uint64(len(userName))))
-	if e != nil {
-		return e
-	}
-	_, e = connection.Write([]byte(userName))
+	e = connection.WriteString(userName)
 	if e != nil {
 		return e
 	}
-
-	// User OS
-	_, e = connection.Write(IntToBytes(uint64(len(userOS))))
+	e = connection.WriteString(userOS)
 	if e != nil {
 		return e
 	}
-	_, e = connection.Write([]byte(userOS))
+	e = connection.WriteUint64(uint64(p.Port))
 	if e != nil {
 		return e
 	}
-
-	// Trans ID
-	_, e = connection.Write(IntToBytes(uint64(len(transID))))
+	e = connection.WriteString(transID)
 	if e != nil {
 		return e
 	}
-	_, e = connection.Write([]byte(transID))
-	if e != nil {
-		return e
-	}
-	return nil
+	return connection.WriteFrame(sig)
 }
 
-func (p *Server) SendMSG(userID string, msg string) {
-	device := GetDevice(userID)
+func (p *Server) SendMSG(ctx context.Context, userID string, msg string) {
+	device := Records.Device(userID)
 	transID := uuid.NewString()
 
 	trans := &Transfer{
@@ -75,201 +64,319 @@ func (p *Server) SendMSG(userID string, msg string) {
 		trans.Error = errors.New("user not found")
 		return
 	}
-	SetTrans(transID, trans)
-	if p.UpdateHistory != nil {
-		p.UpdateHistory(userID)
-		defer p.UpdateHistory(userID)
-	}
-
-	addrPort := netip.AddrPortFrom(*device.Addr, uint16(config.Port))
-	connection, e := net.Dial("tcp", addrPort.String())
-	if e != nil {
+	Records.SetTransfer(trans)
+	e := p.sendMSG(ctx, device, trans)
+	Records.Update(trans, func() {
 		trans.Error = e
-		return
-	}
+		trans.Sended = e == nil
+	})
+	Records.Changed(trans)
+}
 
-	_, e = connection.Write([]byte{MSG})
+func (p *Server) sendMSG(ctx context.Context, device *Device, trans *Transfer) error {
+	connection, e := p.dial(ctx, device)
 	if e != nil {
-		trans.Error = e
-		return
+		return e
 	}
+	defer connection.Close()
 
-	e = p.SendUser(connection, transID)
+	e = connection.Command(MSG)
 	if e != nil {
-		trans.Error = e
-		return
+		return e
 	}
 
-	_, e = connection.Write(IntToBytes(uint64(len(msg))))
+	e = p.SendUser(connection, trans.ID)
 	if e != nil {
-		trans.Error = e
-		return
+		return e
 	}
-	_, e = connection.Write([]byte(msg))
+	e = accepted(connection)
 	if e != nil {
-		trans.Error = e
-		return
+		return e
 	}
 
-	trans.Sended = true
+	return connection.WriteString(trans.MSG)
 }
 
-func (p *Server) SendTrans(userID string, trans *Transfer) {
-	if p.UpdateHistory != nil {
-		defer p.UpdateHistory(userID)
+// hashInterval is how often the progress of hashing is published.
+const hashInterval = 200 * time.Millisecond
+
+// hashFiles digests the files of trans that have no digest yet, the
+// transfer is listed meanwhile. Files that can't be read are left out.
+func hashFiles(ctx context.Context, trans *Transfer) error {
+	file := trans.File
+	hashed := uint64(0)
+	for _, f := range file.Files {
+		if f.Hash != nil {
+			hashed += f.Size
+		}
+	}
+	Records.Update(trans, func() {
+		file.Hashing = true
+		file.Hashed = hashed
+	})
+	defer Records.Update(trans, func() {
+		file.Hashing = false
+	})
+	last := time.Now()
+	files := []*Element{}
+	for _, f := range file.Files {
+		if f.Hash != nil {
+			files = append(files, f)
+			continue
+		}
+		var stop error
+		hash, e := HashFileProgress(f.Path, func(n uint64) error {
+			Records.Update(trans, func() {
+				file.Hashed += n
+			})
+			if time.Since(last) >= hashInterval {
+				last = time.Now()
+				Records.Changed(trans)
+			}
+			if ctx.Err() != nil {
+				stop = ctx.Err()
+			} else if Records.Canceled(trans) {
+				stop = errCanceled
+			}
+			return stop
+		})
+		if stop != nil {
+			return stop
+		}
+		if e != nil {
+			log.Println(f.Path, e)
+			Records.Update(trans, func() {
+				file.TotalBytes -= f.Size
+			})
+			continue
+		}
+		Records.Update(trans, func() {
+			f.Hash = hash
+		})
+		files = append(files, f)
+	}
+	Records.Update(trans, func() {
+		file.Files = files
+	})
+	return nil
+}
+
+func (p *Server) SendTrans(ctx context.Context, userID string, trans *Transfer) {
+	e := p.sendTrans(ctx, userID, trans)
+	Records.Update(trans, func() {
+		trans.Error = transferError(ctx, e)
+		trans.Sended = e == nil && !trans.File.Canceled
+	})
+	Records.Changed(trans)
+}
+
+// sendTrans sends the files of trans that are left, a cancel isn't an
+// error.
+func (p *Server) sendTrans(ctx context.Context, userID string, trans *Transfer) error {
+	e := hashFiles(ctx, trans)
+	if e == errCanceled {
+		return nil
+	}
+	if e != nil {
+		return e
 	}
 
-	device := GetDevice(userID)
+	device := Records.Device(userID)
 	if device == nil {
-		trans.Error = errors.New("user not found")
-		return
+		return errors.New("user not found")
 	}
 
 	// Connecting
-	addrPort := netip.AddrPortFrom(*device.Addr, uint16(config.Port))
-	connection, e := net.Dial("tcp", addrPort.String())
+	connection, e := p.dial(ctx, device)
 	if e != nil {
-		trans.Error = e
-		return
+		return e
 	}
 	defer connection.Close()
 
 	// CTL MSG: RESOURCES
-	_, e = connection.Write([]byte{RESOURCES})
+	e = connection.Command(RESOURCES)
 	if e != nil {
-		trans.Error = e
-		return
+		return e
 	}
 	// Send user info and trans id
 	e = p.SendUser(connection, trans.ID)
 	if e != nil {
-		trans.Error = e
-		return
+		return e
+	}
+	e = accepted(connection)
+	if e != nil {
+		return e
 	}
 
-	// Buf size
-	_, e = connection.Write(IntToBytes(p.conf.BufSize()))
+	// Buf size, the compression offered and whether to send deltas,
+	// a peer without deltas gets the whole files
+	e = connection.WriteUint64(p.conf.BufSize())
 	if e != nil {
-		trans.Error = e
-		return
+		return e
+	}
+	offered := config.CompressNone
+	if connection.Supports(FeatureCompress) {
+		offered = p.conf.Compress()
+		e = connection.WriteUint64(offered)
+		if e != nil {
+			return e
+		}
+	}
+	Records.Update(trans, func() {
+		trans.File.Delta = trans.File.Delta && connection.Supports(FeatureDelta)
+	})
+	if connection.Supports(FeatureDelta) {
+		delta := byte(0)
+		if trans.File.Delta {
+			delta = 1
+		}
+		e = connection.WriteByte(delta)
+		if e != nil {
+			return e
+		}
 	}
 
 	// Total size and total progress
-	_, e = connection.Write(IntToBytes(trans.File.TotalBytes))
+	e = connection.WriteUint64(trans.File.TotalBytes)
 	if e != nil {
-		trans.Error = e
-		return
+		return e
 	}
-	_, e = connection.Write(IntToBytes(trans.File.TransBytes))
+	e = connection.WriteUint64(trans.File.TransBytes)
 	if e != nil {
-		trans.Error = e
-		return
+		return e
 	}
 
 	// files
-	_, e = connection.Write(IntToBytes(uint64(len(trans.File.Files))))
+	e = connection.WriteUint64(uint64(len(trans.File.Files)))
 	if e != nil {
-		trans.Error = e
-		return
+		return e
 	}
 	for _, f := range trans.File.Files {
-		// Send file name
-		_, e = connection.Write(IntToBytes(uint64(len(f.Name))))
+		// File name, size, progress and digest
+		e = connection.WriteString(f.Name)
+		if e != nil {
+			return e
+		}
+		e = connection.WriteUint64(f.Size)
 		if e != nil {
-			trans.Error = e
-			return
+			return e
 		}
-		_, e = connection.Write([]byte(f.Name))
+		e = connection.WriteUint64(f.Prog)
 		if e != nil {
-			trans.Error = e
-			return
+			return e
 		}
-		// File size
-		_, e = connection.Write(IntToBytes(f.Size))
+		e = connection.WriteFrame(f.Hash)
 		if e != nil {
-			trans.Error = e
-			return
+			return e
+		}
+		done := byte(0)
+		if f.Done {
+			done = 1
 		}
-		// File progress
-		_, e = connection.Write(IntToBytes(f.Prog))
+		e = connection.WriteByte(done)
 		if e != nil {
-			trans.Error = e
-			return
+			return e
 		}
 	}
 
 	// current file
-	_, e = connection.Write(IntToBytes(trans.File.Index))
+	e = connection.WriteUint64(trans.File.Index)
 	if e != nil {
-		trans.Error = e
-		return
+		return e
+	}
+
+	// Wait for the user on the other side to accept
+	Records.Update(trans, func() {
+		trans.File.Waiting = true
+	})
+	Records.Changed(trans)
+	connection.SetTimeout(ApprovalTimeout + p.conf.IdleTimeout())
+	ctl, e := connection.ReadByte()
+	Records.Update(trans, func() {
+		trans.File.Waiting = false
+	})
+	if e != nil {
+		return e
+	}
+	switch ctl {
+	case OK:
+	case DENIED:
+		return ErrDeclined
+	default:
+		return errors.New("refused by the receiver")
 	}
 
-	buf := make([]byte, p.conf.BufSize())
-	ctl := make([]byte, 1)
-	for trans.File.Index < uint64(len(trans.File.Files)) {
-		file := trans.File.Files[trans.File.Index]
-		fr, e := os.Open(file.Path)
+	// The receiver grants the first window with its answer, the
+	// streams it takes and the compression it accepts
+	window, e := readWindow(connection)
+	if e != nil {
+		return e
+	}
+	streams, e := connection.ReadUint64()
+	if e != nil {
+		return e
+	}
+	if streams == 0 || streams > MaxStreams {
+		return overLimit("streams", streams, MaxStreams)
+	}
+	mode := config.CompressNone
+	if connection.Supports(FeatureCompress) {
+		mode, e = connection.ReadUint64()
 		if e != nil {
-			trans.Error = e
-			return
+			return e
 		}
-		_, e = fr.Seek(int64(file.Prog), 0)
+	}
+	if mode != config.CompressNone && mode != offered {
+		return fmt.Errorf("%w: compression %d not offered", ErrProtocol, mode)
+	}
+	Records.Update(trans, func() {
+		trans.File.Compress = mode
+	})
+	// and the signatures of the copies it has for a delta transfer
+	var sigs map[int]*signature
+	if trans.File.Delta {
+		sigs, e = readSignatures(connection.Codec, trans.File.Files)
 		if e != nil {
-			trans.Error = e
-			return
+			return e
 		}
+	}
 
-		for file.Prog < file.Size {
-			// Send ctl to cancel or continue
-			if trans.File.Canceled {
-				_, e = connection.Write([]byte{CANCELED})
-				if e != nil {
-					trans.Error = e
-				}
-				return
-			}
-			_, e = connection.Write([]byte{OK})
-			if e != nil {
-				trans.Error = e
-				return
-			}
-
-			t, e := fr.Read(buf)
-			if e != nil {
-				trans.Error = e
-				return
-			}
-			_, e = connection.Write(buf[:t])
-			if e != nil {
-				trans.Error = e
-				return
-			}
-
-			// Check if destiny canceled
-			_, e = connection.Read(ctl)
-			if e != nil {
-				trans.Error = e
-				return
-			}
-			if ctl[0] != OK {
-				trans.File.Canceled = true
-				return
-			}
-
-			file.Prog += uint64(t)
-			trans.File.TransBytes += uint64(t)
-			if p.UpdateHistory != nil {
-				p.UpdateHistory(userID)
-			}
-		}
-		trans.File.Index++
+	// From now on the peer must keep making progress. The files go in
+	// jobs over this connection and the streams that join it, the
+	// progress follows the credits, a resume never skips bytes the
+	// receiver didn't write.
+	out := newOutgoing(trans, sigs)
+	out.add(connection)
+	if n := p.conf.Streams(); streams > n {
+		streams = n
 	}
+	if n := uint64(len(out.jobs)); streams > n {
+		streams = n
+	}
+	var wg sync.WaitGroup
+	for i := uint64(1); i < streams; i++ {
+		wg.Add(1)
+		go func(dev Device) {
+			defer wg.Done()
+			p.joinStream(ctx, dev, out)
+		}(*device)
+	}
+	connection.SetTimeout(p.conf.StallTimeout())
+	out.end(p.sendStream(connection, out, window))
+	wg.Wait()
+	out.settle()
 
-	trans.Sended = true
+	if Records.Canceled(trans) {
+		return nil
+	}
+	e = out.Err()
+	if e == nil && trans.File.Index < uint64(len(trans.File.Files)) {
+		e = ErrInterrupted
+	}
+	return e
 }
 
-func (p *Server) SendResources(userID string, resources []string) {
+func (p *Server) SendResources(ctx context.Context, userID string, resources []string, delta bool) {
 	// Getting total size and files
 	tsize := uint64(0)
 	files := []*Element{}
@@ -334,30 +441,35 @@ func (p *Server) SendResources(userID string, resources []string) {
 		File: &FileTransfer{
 			Files:      files,
 			TotalBytes: tsize,
+			Delta:      delta,
 		},
 	}
-	SetTrans(transID, trans)
-	if p.UpdateHistory != nil {
-		p.UpdateHistory(userID)
-		defer p.UpdateHistory(userID)
-	}
+	Records.SetTransfer(trans)
+	Records.Changed(trans)
+	defer Records.Changed(trans)
 
-	p.SendTrans(userID, trans)
+	p.SendTrans(ctx, userID, trans)
 }
 
-func (p *Server) ContinueSendingTrans(connection net.Conn) {
+func (p *Server) ContinueSendingTrans(connection *Session) {
 	UserID, _, _, TransID, e := p.GetUser(connection)
 	if e != nil {
 		return
 	}
+	if !p.permit(connection, UserID, RESOURCES) {
+		return
+	}
 
-	trans := GetTrans(TransID)
-	if trans == nil {
-		connection.Write([]byte{ERROR})
+	// Only the receiver of files we sent may resume them
+	trans := Records.live(TransID)
+	if trans == nil || trans.In || trans.File == nil || trans.UserID != UserID {
+		connection.WriteByte(ERROR)
 		return
 	}
-	connection.Write([]byte{OK})
+	connection.WriteByte(OK)
 
-	trans.File.Canceled = false
-	p.SendTrans(UserID, trans)
+	Records.Update(trans, func() {
+		trans.File.Canceled = false
+	})
+	p.SendTrans(p.ctx, UserID, trans)
 }
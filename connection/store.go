@@ -0,0 +1,220 @@
+package connection
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/netip"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/julioguillermo/jg_sender/config"
+)
+
+const (
+	HistoryFile = "history"
+	DevicesFile = "devices"
+)
+
+// SaveInterval throttles the writes while transfers make progress.
+const SaveInterval = time.Second
+
+var ErrInterrupted = errors.New("interrupted")
+
+// knownErrors are restored as themselves so errors.Is keeps working
+// after a restart.
+var knownErrors = []error{
+	ErrInterrupted,
+	ErrDeclined,
+	ErrNotPaired,
+	ErrPairRefused,
+	ErrPairCanceled,
+	ErrPairWrongCode,
+	ErrPinMismatch,
+	ErrSpoofed,
+	ErrUnsupported,
+	ErrIncompatible,
+}
+
+func restoreError(msg string) error {
+	if msg == "" {
+		return nil
+	}
+	for _, e := range knownErrors {
+		if e.Error() == msg {
+			return e
+		}
+	}
+	return errors.New(msg)
+}
+
+type transferAlias Transfer
+
+// transferRecord is the stored form of a Transfer, with the error as
+// its message.
+type transferRecord struct {
+	*transferAlias
+	Error string `json:",omitempty"`
+}
+
+func (p *Transfer) MarshalJSON() ([]byte, error) {
+	rec := transferRecord{transferAlias: (*transferAlias)(p)}
+	if p.Error != nil {
+		rec.Error = p.Error.Error()
+	}
+	return json.Marshal(rec)
+}
+
+func (p *Transfer) UnmarshalJSON(buf []byte) error {
+	rec := transferRecord{transferAlias: (*transferAlias)(p)}
+	err := json.Unmarshal(buf, &rec)
+	if err != nil {
+		return err
+	}
+	p.Error = restoreError(rec.Error)
+	return nil
+}
+
+type deviceAlias Device
+
+// deviceRecord reads the address of devices saved before it had a
+// port, they listened on the default one. An unreadable address is
+// dropped, the device is found again by discovery.
+type deviceRecord struct {
+	*deviceAlias
+	Addr string
+}
+
+func (p *Device) UnmarshalJSON(buf []byte) error {
+	rec := deviceRecord{deviceAlias: (*deviceAlias)(p)}
+	err := json.Unmarshal(buf, &rec)
+	if err != nil {
+		return err
+	}
+	p.Addr = nil
+	if rec.Addr == "" {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(rec.Addr)
+	if err != nil {
+		addr, e := netip.ParseAddr(rec.Addr)
+		if e != nil {
+			return nil
+		}
+		addrPort = netip.AddrPortFrom(addr, config.Port)
+	}
+	p.Addr = &addrPort
+	return nil
+}
+
+// HistoryStore keeps the transfers and devices of Records in dir across
+// restarts. The changes are written by its own goroutine, changed wakes
+// it up.
+type HistoryStore struct {
+	mu      sync.Mutex
+	dir     string
+	changed chan struct{}
+}
+
+var Store *HistoryStore
+
+// LoadStore reads the saved history and devices of dir. Transfers that
+// were running when the app closed are marked as interrupted, they can
+// be resumed with ContinueTrans.
+func LoadStore(dir string) *HistoryStore {
+	store := &HistoryStore{
+		dir:     dir,
+		changed: make(chan struct{}, 1),
+	}
+
+	history := []*Transfer{}
+	buf, err := ioutil.ReadFile(path.Join(dir, HistoryFile))
+	if err == nil && json.Unmarshal(buf, &history) != nil {
+		history = []*Transfer{}
+	}
+	devices := []*Device{}
+	buf, err = ioutil.ReadFile(path.Join(dir, DevicesFile))
+	if err == nil && json.Unmarshal(buf, &devices) != nil {
+		devices = []*Device{}
+	}
+
+	for _, t := range history {
+		if t.File == nil {
+			continue
+		}
+		t.File.Waiting = false
+		t.File.Hashing = false
+		// Saved before files were marked, those before Index are done
+		for i := uint64(0); i < t.File.Index && i < uint64(len(t.File.Files)); i++ {
+			t.File.Files[i].Done = true
+		}
+		if t.Error == nil && !t.File.Canceled && t.File.Index < uint64(len(t.File.Files)) {
+			t.Error = ErrInterrupted
+		}
+	}
+	for _, d := range devices {
+		d.Online = false
+		if len(d.Names) == 0 && d.Name != "" {
+			d.Names = []string{d.Name}
+		}
+		if len(d.Addrs) == 0 && d.Addr != nil {
+			d.Addrs = []netip.AddrPort{*d.Addr}
+		}
+	}
+	Records.Load(history, devices)
+
+	Records.Subscribe(func(Event) {
+		store.Changed()
+	})
+	go store.writer()
+	return store
+}
+
+func writeJSON(file string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Save writes the history and the devices now.
+func (p *HistoryStore) Save() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	history, devices := Records.Snapshot()
+	os.MkdirAll(p.dir, 0777)
+	err := writeJSON(path.Join(p.dir, HistoryFile), history)
+	if err != nil {
+		return err
+	}
+	return writeJSON(path.Join(p.dir, DevicesFile), devices)
+}
+
+// Changed asks the writer to save, it never blocks the caller.
+func (p *HistoryStore) Changed() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// writer saves after every change, at most once every SaveInterval.
+// The changes made meanwhile go in the next save.
+func (p *HistoryStore) writer() {
+	for range p.changed {
+		err := p.Save()
+		if err != nil {
+			log.Println(err)
+		}
+		time.Sleep(SaveInterval)
+	}
+}
@@ -0,0 +1,967 @@
+package connection
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/julioguillermo/jg_sender/config"
+)
+
+// A transfer runs over the RESOURCES connection and up to Streams more
+// opened with STREAM, which name the transfer in the signed user header.
+// Every stream carries jobs: RANGE with the file index, offset and
+// length, the DATA frames of the range, COPY for a delta (see delta.go),
+// and DONE when the sender has no more jobs. The receiver writes each
+// range in place in the .tmp of the file, checks a file once its last
+// byte arrived and answers OK or ERROR with the index on the stream that
+// brought it, then echoes DONE.
+
+const (
+	// StreamSegment is the size big files are cut in, the segments of
+	// a file may go over different streams. It is fixed, a resume
+	// finds the same segments.
+	StreamSegment = 32 << 20
+	// MaxStreams caps the streams a receiver may offer.
+	MaxStreams = 16
+)
+
+// rangeHeader is the RANGE byte, the file index, offset and length.
+const rangeHeader = 25
+
+// segments is how many segments a file of size is cut in.
+func segments(size uint64) int {
+	if size <= StreamSegment {
+		return 1
+	}
+	return int((size + StreamSegment - 1) / StreamSegment)
+}
+
+// segmentSize is the length of segment seg of a file of size.
+func segmentSize(size uint64, seg int) uint64 {
+	off := uint64(seg) * StreamSegment
+	if size-off < StreamSegment {
+		return size - off
+	}
+	return StreamSegment
+}
+
+// parts is the progress of each segment, transfers saved before the
+// segments only know the contiguous Prog.
+func (p *Element) parts() []uint64 {
+	n := segments(p.Size)
+	if len(p.Parts) == n {
+		return p.Parts
+	}
+	parts := make([]uint64, n)
+	prog := p.Prog
+	for i := range parts {
+		parts[i] = segmentSize(p.Size, i)
+		if prog < parts[i] {
+			parts[i] = prog
+		}
+		prog -= parts[i]
+	}
+	return parts
+}
+
+// advance counts n more bytes of segment seg as written.
+func (p *Element) advance(seg int, n uint64) {
+	if segments(p.Size) > 1 {
+		p.Parts = p.parts()
+		p.Parts[seg] += n
+	}
+	p.Prog += n
+}
+
+// job is a range of a file sent over one stream, or the whole file
+// against delta.
+type job struct {
+	index  int
+	seg    int
+	off    uint64
+	length uint64
+	delta  *signature
+}
+
+// outgoing is a transfer being sent, its streams take the next job
+// from it and count the bytes the receiver acked.
+type outgoing struct {
+	mu       sync.Mutex
+	trans    *Transfer
+	jobs     []job
+	sessions []*Session
+	failed   bool
+	err      error
+
+	// Files that failed their check, late credits don't count
+	reset map[int]bool
+	// Whether each file is worth deflating, judged once
+	packed map[int]bool
+	// Bytes of each delta file acked so far, they don't fill segments
+	// in order so only the verdict makes them Prog
+	partial map[int]uint64
+}
+
+// newOutgoing queues what is left of every file not done yet, a file
+// with all its bytes acked still needs the receiver to check it. A file
+// with a signature in sigs goes whole as a delta.
+func newOutgoing(trans *Transfer, sigs map[int]*signature) *outgoing {
+	out := &outgoing{
+		trans:   trans,
+		reset:   map[int]bool{},
+		packed:  map[int]bool{},
+		partial: map[int]uint64{},
+	}
+	for i, file := range trans.File.Files {
+		if file.Done {
+			continue
+		}
+		if sig := sigs[i]; sig != nil {
+			out.jobs = append(out.jobs, job{index: i, length: file.Size, delta: sig})
+			continue
+		}
+		queued := false
+		for seg, prog := range file.parts() {
+			size := segmentSize(file.Size, seg)
+			if prog < size {
+				out.jobs = append(out.jobs, job{
+					index:  i,
+					seg:    seg,
+					off:    uint64(seg)*StreamSegment + prog,
+					length: size - prog,
+				})
+				queued = true
+			}
+		}
+		if !queued {
+			out.jobs = append(out.jobs, job{index: i, off: file.Size})
+		}
+	}
+	return out
+}
+
+// add registers a stream to close if the transfer fails, it returns
+// false once it did.
+func (p *outgoing) add(connection *Session) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failed {
+		return false
+	}
+	p.sessions = append(p.sessions, connection)
+	return true
+}
+
+func (p *outgoing) next() (job, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failed || len(p.jobs) == 0 {
+		return job{}, false
+	}
+	j := p.jobs[0]
+	p.jobs = p.jobs[1:]
+	return j, true
+}
+
+// acked counts n bytes of j as written by the receiver.
+func (p *outgoing) acked(j job, n uint64) {
+	p.mu.Lock()
+	file := p.trans.File.Files[j.index]
+	if !file.Done && !p.reset[j.index] {
+		if j.delta != nil {
+			p.partial[j.index] += n
+		}
+		Records.Update(p.trans, func() {
+			if j.delta == nil {
+				file.advance(j.seg, n)
+			}
+			p.trans.File.TransBytes += n
+		})
+	}
+	p.mu.Unlock()
+	Records.Changed(p.trans)
+}
+
+// sent counts the bytes of the files and the ones on the wire.
+func (p *outgoing) sent(raw, wire uint64) {
+	Records.Update(p.trans, func() {
+		p.trans.File.Raw += raw
+		p.trans.File.Wire += wire
+	})
+}
+
+// compressible tells if file index is worth deflating.
+func (p *outgoing) compressible(index int) bool {
+	p.mu.Lock()
+	packed, ok := p.packed[index]
+	p.mu.Unlock()
+	if ok {
+		return !packed
+	}
+	packed = !compressible(p.trans.File.Files[index].Path)
+	p.mu.Lock()
+	p.packed[index] = packed
+	p.mu.Unlock()
+	return !packed
+}
+
+// verdict takes the answer of the receiver for a file. The files
+// before Index are all done, the others may finish in any order.
+func (p *outgoing) verdict(index uint64, ok bool) error {
+	p.mu.Lock()
+	defer Records.Changed(p.trans)
+	defer p.mu.Unlock()
+	files := p.trans.File.Files
+	if index >= uint64(len(files)) || files[index].Done {
+		return fmt.Errorf("%w: verdict for file %d", ErrProtocol, index)
+	}
+	file := files[index]
+	partial := p.partial[int(index)]
+	delete(p.partial, int(index))
+	if !ok {
+		p.reset[int(index)] = true
+		Records.Update(p.trans, func() {
+			p.trans.File.TransBytes -= file.Prog + partial
+			file.Prog = 0
+			file.Parts = nil
+		})
+		return fmt.Errorf("%w: %s", ErrChecksum, file.Name)
+	}
+	Records.Update(p.trans, func() {
+		p.trans.File.TransBytes += file.Size - file.Prog - partial
+		file.Prog = file.Size
+		file.Parts = nil
+		file.Done = true
+		for p.trans.File.Index < uint64(len(files)) && files[p.trans.File.Index].Done {
+			p.trans.File.Index++
+		}
+	})
+	return nil
+}
+
+// end takes how a stream ended. A failure stops the other streams, a
+// cancel is seen by each of them.
+func (p *outgoing) end(e error) {
+	switch e {
+	case nil, errCanceled:
+	case errPeerCanceled:
+		Records.Update(p.trans, func() {
+			p.trans.File.Canceled = true
+		})
+	default:
+		p.mu.Lock()
+		if p.failed {
+			p.mu.Unlock()
+			return
+		}
+		p.failed = true
+		p.err = e
+		sessions := p.sessions
+		p.mu.Unlock()
+		for _, s := range sessions {
+			s.Close()
+		}
+	}
+}
+
+// settle drops the progress of the delta files left unchecked, a
+// resume sends them again from the start.
+func (p *outgoing) settle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	Records.Update(p.trans, func() {
+		for _, n := range p.partial {
+			p.trans.File.TransBytes -= n
+		}
+	})
+	p.partial = map[int]uint64{}
+}
+
+// Err is the failure that stopped the transfer.
+func (p *outgoing) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// readWindow reads the first window a receiver grants a stream.
+func readWindow(connection *Session) (uint64, error) {
+	window, e := connection.ReadUint64()
+	if e == nil && (window == 0 || window > FlowWindow<<4) {
+		e = overLimit("window", window, FlowWindow<<4)
+	}
+	return window, e
+}
+
+// sendStream sends jobs of out over connection until there are none
+// left, then waits for the receiver to check the files it completed.
+func (p *Server) sendStream(connection *Session, out *outgoing, window uint64) error {
+	flw := newFlow(window)
+	flw.verdict = out.verdict
+	go flw.readControl(connection.Codec)
+	stop := func(e error) error {
+		if err := flw.Err(); err != nil && err != errStreamDone {
+			return err
+		}
+		return e
+	}
+	canceled := func() bool {
+		return Records.Canceled(out.trans)
+	}
+
+	// The credits come back in the order the bytes went out, they go
+	// to the jobs in that order
+	var sent []job
+	acked := uint64(0)
+	account := func() {
+		n := flw.Acked() - acked
+		acked += n
+		for n > 0 && len(sent) > 0 {
+			t := n
+			if t > sent[0].length {
+				t = sent[0].length
+			}
+			out.acked(sent[0], t)
+			sent[0].length -= t
+			n -= t
+			if sent[0].length == 0 {
+				sent = sent[1:]
+			}
+		}
+	}
+
+	// Chunks of files worth it go deflated when the peers agreed to,
+	// the compressor counts the bytes on the wire either way
+	z := newCompressor()
+	raw, wire := uint64(0), uint64(0)
+	progress := func() {
+		account()
+		out.sent(z.raw-raw, z.wire-wire)
+		raw, wire = z.raw, z.wire
+	}
+	compress := out.trans.File.Compress != config.CompressNone
+
+	// The configured buffer is the biggest chunk, the tuner picks the
+	// size that moves the most bytes on this link
+	tuner := newChunkTuner(p.conf.BufSize())
+	buf := make([]byte, frameHeader+p.conf.BufSize())
+	header := make([]byte, copyHeader)
+	sendRange := func(fr *os.File, j job) error {
+		header[0] = RANGE
+		copy(header[1:9], IntToBytes(uint64(j.index)))
+		copy(header[9:17], IntToBytes(j.off))
+		copy(header[17:rangeHeader], IntToBytes(j.length))
+		e := connection.WriteAll(header[:rangeHeader])
+		if e != nil {
+			return e
+		}
+		if j.length > 0 {
+			sent = append(sent, j)
+		}
+		r := io.NewSectionReader(fr, int64(j.off), int64(j.length))
+		return streamFile(connection, flw, tuner, z, r, 0, j.length, buf, canceled, progress)
+	}
+	// sendDelta sends the new data of a delta job as ranges within its
+	// segments and the blocks the receiver has as COPY
+	sendDelta := func(fr *os.File, j job) error {
+		literal := func(off, length uint64) error {
+			for length > 0 {
+				seg := int(off / StreamSegment)
+				n := uint64(seg+1)*StreamSegment - off
+				if n > length {
+					n = length
+				}
+				e := sendRange(fr, job{index: j.index, seg: seg, off: off, length: n, delta: j.delta})
+				if e != nil {
+					return e
+				}
+				off += n
+				length -= n
+			}
+			return nil
+		}
+		copyBlock := func(dst, src, length uint64) error {
+			if canceled() {
+				return errCanceled
+			}
+			header[0] = COPY
+			copy(header[1:9], IntToBytes(uint64(j.index)))
+			copy(header[9:17], IntToBytes(dst))
+			copy(header[17:25], IntToBytes(src))
+			copy(header[25:], IntToBytes(length))
+			e := connection.WriteAll(header)
+			if e != nil {
+				return e
+			}
+			out.sent(length, 0)
+			out.acked(j, length)
+			return nil
+		}
+		return scanDelta(io.NewSectionReader(fr, 0, int64(j.length)), j.length, j.delta, literal, copyBlock)
+	}
+	for {
+		j, ok := out.next()
+		if !ok {
+			break
+		}
+		file := out.trans.File.Files[j.index]
+		fr, e := os.Open(file.Path)
+		if e != nil {
+			return e
+		}
+		adviseSequential(fr)
+
+		z.deflate = compress && j.length > 0 && out.compressible(j.index)
+		if j.delta != nil {
+			e = sendDelta(fr, j)
+		} else {
+			e = sendRange(fr, j)
+		}
+		fr.Close()
+		if e == errCanceled {
+			e = connection.WriteByte(CANCELED)
+			if e != nil {
+				return e
+			}
+			flw.wait(CancelDrain)
+			return errCanceled
+		}
+		if e != nil {
+			return stop(e)
+		}
+	}
+
+	e := connection.WriteByte(DONE)
+	if e != nil {
+		return stop(e)
+	}
+	// Hashing a big file takes a while
+	connection.SetTimeout(0)
+	<-flw.done
+	account()
+	return stop(nil)
+}
+
+// joinStream opens one more stream to device for out, a stream that
+// can't join leaves its jobs to the others.
+func (p *Server) joinStream(ctx context.Context, device Device, out *outgoing) {
+	connection, e := p.dial(ctx, &device)
+	if e != nil {
+		log.Println(device.ID, e)
+		return
+	}
+	defer connection.Close()
+
+	e = connection.Command(STREAM)
+	if e == nil {
+		e = p.SendUser(connection, out.trans.ID)
+	}
+	var status byte
+	if e == nil {
+		status, e = connection.ReadByte()
+	}
+	// The transfer may be over or have all the streams it takes
+	if e == nil && status != OK {
+		return
+	}
+	var window uint64
+	if e == nil {
+		window, e = readWindow(connection)
+	}
+	if e != nil {
+		log.Println(connection.RemoteAddr(), e)
+		return
+	}
+	if !out.add(connection) {
+		return
+	}
+	connection.SetTimeout(p.conf.StallTimeout())
+	out.end(p.sendStream(connection, out, window))
+}
+
+// incoming is a transfer being received, every stream writes the ranges
+// it gets into the files of it.
+type incoming struct {
+	mu      sync.Mutex
+	trans   *Transfer
+	bufSize uint64
+	open    map[uint64]*inFile
+	streams uint64
+	active  int
+	pending int
+	err     error
+	ended   bool
+	done    chan struct{}
+}
+
+// inFile is a file being written, left is what still has to arrive.
+// basis is the old copy a delta transfer copies blocks from.
+type inFile struct {
+	f         *os.File
+	left      uint64
+	checking  bool
+	basis     *os.File
+	basisSize uint64
+}
+
+func newIncoming(trans *Transfer, bufSize uint64) *incoming {
+	in := &incoming{
+		trans:   trans,
+		bufSize: bufSize,
+		open:    map[uint64]*inFile{},
+		streams: 1,
+		active:  1,
+		done:    make(chan struct{}),
+	}
+	for _, file := range trans.File.Files {
+		if !file.Done {
+			in.pending++
+		}
+	}
+	if in.pending == 0 {
+		in.finish(nil)
+	}
+	return in
+}
+
+func (p *incoming) tmp(file *Element) string {
+	return file.Path + "_" + p.trans.ID + ".tmp"
+}
+
+// begin checks a range and opens its file on the first one. A resumed
+// file keeps what its .tmp already has.
+func (p *incoming) begin(index, off, length uint64) (*inFile, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	files := p.trans.File.Files
+	if index >= uint64(len(files)) || files[index].Done {
+		return nil, fmt.Errorf("%w: range of file %d", ErrProtocol, index)
+	}
+	file := files[index]
+	if off > file.Size || length > file.Size-off {
+		return nil, fmt.Errorf("%w: range past the end of the file", ErrProtocol)
+	}
+	in := p.open[index]
+	if in != nil {
+		return in, nil
+	}
+
+	dir := path.Dir(file.Path)
+	if dir != "." {
+		e := os.MkdirAll(dir, 0777)
+		if e != nil {
+			return nil, e
+		}
+	}
+	var (
+		f *os.File
+		e error
+	)
+	if file.Prog == 0 {
+		f, e = os.Create(p.tmp(file))
+	} else {
+		f, e = os.OpenFile(p.tmp(file), os.O_RDWR, 0777)
+	}
+	if e != nil {
+		return nil, e
+	}
+	in = &inFile{f: f, left: file.Size - file.Prog}
+	p.open[index] = in
+	return in, nil
+}
+
+// copyBlock copies length bytes at src of the old copy of a file of a
+// delta transfer to dst of its .tmp.
+func (p *incoming) copyBlock(in *inFile, index, dst, src, length uint64, buf []byte) error {
+	if !p.trans.File.Replace {
+		return fmt.Errorf("%w: copy without delta", ErrProtocol)
+	}
+	if in.basis == nil {
+		f, e := os.Open(p.trans.File.Files[index].Path)
+		if e != nil {
+			return e
+		}
+		inf, e := f.Stat()
+		if e != nil {
+			f.Close()
+			return e
+		}
+		in.basis, in.basisSize = f, uint64(inf.Size())
+	}
+	if src > in.basisSize || length > in.basisSize-src {
+		return fmt.Errorf("%w: copy past the end of the old file", ErrProtocol)
+	}
+	for length > 0 {
+		n := uint64(len(buf))
+		if n > length {
+			n = length
+		}
+		_, e := in.basis.ReadAt(buf[:n], int64(src))
+		if e != nil {
+			return e
+		}
+		_, e = in.f.WriteAt(buf[:n], int64(dst))
+		if e != nil {
+			return e
+		}
+		src, dst, length = src+n, dst+n, length-n
+	}
+	return nil
+}
+
+// closeFiles closes the .tmp of a file and its old copy.
+func (p *inFile) closeFiles() {
+	p.f.Close()
+	if p.basis != nil {
+		p.basis.Close()
+	}
+}
+
+// wrote counts n more bytes of a file that took wire bytes on the
+// network, it reports true once to the stream that completed it.
+func (p *incoming) wrote(index, n, wire uint64) (bool, error) {
+	p.mu.Lock()
+	defer Records.Changed(p.trans)
+	defer p.mu.Unlock()
+	in := p.open[index]
+	if n > in.left {
+		return false, fmt.Errorf("%w: more bytes than the file has", ErrProtocol)
+	}
+	in.left -= n
+	Records.Update(p.trans, func() {
+		p.trans.File.Files[index].Prog += n
+		p.trans.File.TransBytes += n
+		p.trans.File.Raw += n
+		p.trans.File.Wire += wire
+	})
+	if in.left > 0 || in.checking {
+		return false, nil
+	}
+	in.checking = true
+	return true, nil
+}
+
+// check verifies a complete file before exposing it, a delta transfer
+// the receiver accepted to replace with replaces the old copy.
+func (p *incoming) check(index uint64) error {
+	p.mu.Lock()
+	file := p.trans.File.Files[index]
+	in := p.open[index]
+	p.mu.Unlock()
+	defer Records.Changed(p.trans)
+
+	in.closeFiles()
+	tmp := p.tmp(file)
+	hash, e := HashFile(tmp)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.open, index)
+	if e != nil || !bytes.Equal(hash, file.Hash) {
+		os.Remove(tmp)
+		Records.Update(p.trans, func() {
+			p.trans.File.TransBytes -= file.Prog
+			file.Prog = 0
+		})
+		return fmt.Errorf("%w: %s", ErrChecksum, file.Name)
+	}
+	// Locked, two files can't take the same free name
+	dst := file.Path
+	if !p.trans.File.Replace {
+		dst = CheckName(dst)
+	}
+	e = os.Rename(tmp, dst)
+	if e != nil {
+		return e
+	}
+	files := p.trans.File.Files
+	Records.Update(p.trans, func() {
+		file.Done = true
+		for p.trans.File.Index < uint64(len(files)) && files[p.trans.File.Index].Done {
+			p.trans.File.Index++
+		}
+	})
+	p.pending--
+	if p.pending == 0 {
+		p.finishLocked(nil)
+	}
+	return nil
+}
+
+func (p *incoming) finish(e error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.finishLocked(e)
+}
+
+func (p *incoming) finishLocked(e error) {
+	if p.ended {
+		return
+	}
+	p.ended = true
+	p.err = e
+	close(p.done)
+}
+
+// end takes how a stream ended, a cancel or failure of one ends the
+// whole transfer.
+func (p *incoming) end(e error) {
+	switch e {
+	case nil:
+	case errCanceled, errPeerCanceled:
+		Records.Update(p.trans, func() {
+			p.trans.File.Canceled = true
+		})
+		p.finish(nil)
+	default:
+		p.finish(e)
+	}
+}
+
+// leave takes how a stream ended like end, the last one to end with
+// files still pending fails the transfer.
+func (p *incoming) leave(e error) {
+	p.end(e)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active--
+	if p.active == 0 && p.pending > 0 {
+		p.finishLocked(fmt.Errorf("%w: streams ended before %d of the files arrived", ErrProtocol, p.pending))
+	}
+}
+
+// Wait blocks until every file is checked, the transfer ended or ctx
+// is done.
+func (p *incoming) Wait(ctx context.Context) error {
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		p.finish(ctx.Err())
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// close closes the files left open by a transfer that ended early,
+// the streams still writing them fail.
+func (p *incoming) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, in := range p.open {
+		in.closeFiles()
+	}
+}
+
+// replies serializes what a receiving stream writes back, the verdicts
+// come from the goroutines checking the files.
+type replies struct {
+	mu    sync.Mutex
+	codec *Codec
+}
+
+func (p *replies) write(buf []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.codec.WriteAll(buf)
+}
+
+// receiveStream writes the ranges sent over connection until the sender
+// is done with it.
+func (p *Server) receiveStream(connection *Session, in *incoming) error {
+	out := &replies{codec: connection.Codec}
+	win := newWindow()
+	if in.trans.File.Compress != config.CompressNone {
+		win.inflate = newInflater(in.bufSize)
+	}
+	buf := make([]byte, in.bufSize)
+	header := make([]byte, copyHeader-1)
+	var checking sync.WaitGroup
+	defer checking.Wait()
+	cancel := func() error {
+		e := out.write([]byte{CANCELED})
+		if e == nil {
+			drain(connection)
+		}
+		return errCanceled
+	}
+	for {
+		ctl, e := connection.ReadByte()
+		if e != nil {
+			return e
+		}
+		switch ctl {
+		case RANGE, COPY:
+		case CANCELED:
+			return errPeerCanceled
+		case DONE:
+			checking.Wait()
+			e = win.consume(out.write, 0, true)
+			if e != nil {
+				return e
+			}
+			return out.write([]byte{DONE})
+		default:
+			return fmt.Errorf("%w: control %d", ErrProtocol, ctl)
+		}
+
+		if ctl == COPY {
+			e = connection.ReadFull(header)
+		} else {
+			e = connection.ReadFull(header[:rangeHeader-1])
+		}
+		if e != nil {
+			return e
+		}
+		index, off, length := BytesToInt(header[:8]), BytesToInt(header[8:16]), BytesToInt(header[16:24])
+		src := uint64(0)
+		if ctl == COPY {
+			src, length = length, BytesToInt(header[24:])
+		}
+		file, e := in.begin(index, off, length)
+		if e != nil {
+			return e
+		}
+		complete := false
+		if ctl == COPY {
+			e = in.copyBlock(file, index, off, src, length, buf)
+			if e != nil {
+				return e
+			}
+			complete, e = in.wrote(index, length, 0)
+			if e != nil {
+				return e
+			}
+			if Records.Canceled(in.trans) {
+				return cancel()
+			}
+			length = 0
+		} else if length == 0 {
+			complete, e = in.wrote(index, 0, 0)
+			if e != nil {
+				return e
+			}
+		}
+		for got := uint64(0); got < length; {
+			t, wire, e := win.readChunk(connection.Codec, buf, length-got)
+			if e != nil {
+				return e
+			}
+			_, e = file.f.WriteAt(buf[:t], int64(off+got))
+			if e != nil {
+				return e
+			}
+			got += uint64(t)
+			complete, e = in.wrote(index, uint64(t), uint64(wire))
+			if e != nil {
+				return e
+			}
+
+			if Records.Canceled(in.trans) {
+				return cancel()
+			}
+			e = win.consume(out.write, uint64(t), false)
+			if e != nil {
+				return e
+			}
+		}
+		if !complete {
+			continue
+		}
+
+		// The sender counts its progress from the credits, what this
+		// stream wrote is granted before the verdict. The check runs
+		// aside, hashing a big file takes a while.
+		e = win.consume(out.write, 0, true)
+		if e != nil {
+			return e
+		}
+		checking.Add(1)
+		go func(index uint64) {
+			defer checking.Done()
+			verdict := make([]byte, 9)
+			verdict[0] = OK
+			e := in.check(index)
+			if e != nil {
+				verdict[0] = ERROR
+				in.end(e)
+			}
+			copy(verdict[1:], IntToBytes(index))
+			out.write(verdict)
+		}(index)
+	}
+}
+
+// streams is how many streams this device takes for a transfer.
+func (p *Server) streams() uint64 {
+	n := p.conf.Streams()
+	if n > MaxStreams {
+		return MaxStreams
+	}
+	return n
+}
+
+func (p *Server) register(transID string, in *incoming) {
+	p.inMu.Lock()
+	defer p.inMu.Unlock()
+	if p.incoming == nil {
+		p.incoming = map[string]*incoming{}
+	}
+	p.incoming[transID] = in
+}
+
+func (p *Server) unregister(transID string, in *incoming) {
+	p.inMu.Lock()
+	defer p.inMu.Unlock()
+	if p.incoming[transID] == in {
+		delete(p.incoming, transID)
+	}
+}
+
+// joining finds the running transfer a stream asks for, the user has to
+// be the one sending it and within the streams it was offered.
+func (p *Server) joining(transID, userID string) *incoming {
+	p.inMu.Lock()
+	in := p.incoming[transID]
+	p.inMu.Unlock()
+	if in == nil || in.trans.UserID != userID {
+		return nil
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.ended || in.streams >= p.streams() {
+		return nil
+	}
+	in.streams++
+	in.active++
+	return in
+}
+
+// GetStream joins one more connection to a transfer being received.
+func (p *Server) GetStream(connection *Session) {
+	userID, _, _, transID, e := p.GetUser(connection)
+	if e != nil {
+		return
+	}
+	in := p.joining("R"+transID, userID)
+	if in == nil {
+		connection.WriteByte(ERROR)
+		return
+	}
+	e = connection.WriteByte(OK)
+	if e == nil {
+		e = connection.WriteUint64(FlowWindow)
+	}
+	if e != nil {
+		return
+	}
+	connection.SetTimeout(p.conf.StallTimeout())
+	e = p.receiveStream(connection, in)
+	logProtocol(connection, e)
+	in.leave(e)
+}
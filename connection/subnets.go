@@ -5,6 +5,7 @@ import (
 	"net/netip"
 )
 
+// GetIPS returns the IPv4 and IPv6 subnets of every interface.
 func GetIPS() []*netip.Prefix {
 	ips := []*netip.Prefix{}
 
@@ -20,7 +21,7 @@ func GetIPS() []*netip.Prefix {
 				pre, err := netip.ParsePrefix(a.String())
 				if err == nil {
 					ip := pre.Addr()
-					if ip.Is4() && !ip.IsLoopback() && !ip.IsMulticast() && !ip.IsUnspecified() {
+					if !ip.IsLoopback() && !ip.IsMulticast() && !ip.IsUnspecified() {
 						ips = append(ips, &pre)
 					}
 				}
@@ -30,3 +31,48 @@ func GetIPS() []*netip.Prefix {
 
 	return ips
 }
+
+// Broadcast returns the directed broadcast address of an IPv4 subnet,
+// IPv6 has no broadcast.
+func Broadcast(sn *netip.Prefix) (netip.Addr, bool) {
+	if !sn.Addr().Is4() {
+		return netip.Addr{}, false
+	}
+	ip := sn.Masked().Addr().As4()
+	host := 32 - sn.Bits()
+	for i := 3; i >= 0 && host > 0; i-- {
+		bits := host
+		if bits > 8 {
+			bits = 8
+		}
+		ip[i] |= byte(1<<bits - 1)
+		host -= bits
+	}
+	return netip.AddrFrom4(ip), true
+}
+
+// remoteAddr returns the address of the peer, link-local IPv6 addresses
+// keep their zone.
+func remoteAddr(conn net.Conn) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
+
+// linkInterfaces returns the interfaces that can reach a link-local
+// multicast group.
+func linkInterfaces() []net.Interface {
+	res := []net.Interface{}
+	inters, err := net.Interfaces()
+	if err != nil {
+		return res
+	}
+	for _, i := range inters {
+		if i.Flags&net.FlagUp != 0 && i.Flags&net.FlagMulticast != 0 && i.Flags&net.FlagLoopback == 0 {
+			res = append(res, i)
+		}
+	}
+	return res
+}
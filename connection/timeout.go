@@ -0,0 +1,78 @@
+package connection
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var ErrStalled = errors.New("stalled")
+
+// timedConn renews the deadline before every read and write, so the
+// connection fails once the peer stays silent for longer than the
+// timeout. A zero timeout waits for the TCP keep-alive to give up.
+type timedConn struct {
+	net.Conn
+	timeout int64
+}
+
+func newTimedConn(conn net.Conn, timeout time.Duration) *timedConn {
+	return &timedConn{Conn: conn, timeout: int64(timeout)}
+}
+
+// SetTimeout also moves the deadline of a read or write already
+// waiting, e.g. the one of a goroutine reading control frames.
+func (p *timedConn) SetTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&p.timeout, int64(timeout))
+	p.Conn.SetDeadline(p.deadline())
+}
+
+func (p *timedConn) deadline() time.Time {
+	timeout := time.Duration(atomic.LoadInt64(&p.timeout))
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+func (p *timedConn) Read(b []byte) (int, error) {
+	p.Conn.SetReadDeadline(p.deadline())
+	return p.Conn.Read(b)
+}
+
+func (p *timedConn) Write(b []byte) (int, error) {
+	p.Conn.SetWriteDeadline(p.deadline())
+	return p.Conn.Write(b)
+}
+
+// timedOf finds the timedConn under a TLS connection.
+func timedOf(conn net.Conn) *timedConn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	timed, _ := conn.(*timedConn)
+	return timed
+}
+
+func isTimeout(e error) bool {
+	var ne net.Error
+	return errors.As(e, &ne) && ne.Timeout()
+}
+
+// transferError turns the error a transfer ended with into the one
+// the history shows.
+func transferError(ctx context.Context, e error) error {
+	if e == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ErrInterrupted
+	}
+	if isTimeout(e) {
+		return ErrStalled
+	}
+	return e
+}
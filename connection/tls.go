@@ -0,0 +1,243 @@
+package connection
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	CertFile = "cert.pem"
+	KeyFile  = "key.pem"
+	PinsFile = "pins"
+)
+
+var (
+	ErrPinMismatch = errors.New("security warning: device certificate changed")
+	ErrUnverified  = errors.New("device identity not verified")
+)
+
+const (
+	// BindingLabel names the keying material exported from the TLS
+	// session for the signatures, BindingSize is its length.
+	BindingLabel = "EXPORTER-jg_sender-binding"
+	BindingSize  = 32
+)
+
+var (
+	serverTLS *tls.Config
+	clientTLS *tls.Config
+	Pins      *PinStore
+)
+
+// InitTLS loads (or creates on first run) the device certificate and the
+// pinned fingerprints of known peers stored in dir.
+func InitTLS(dir string) error {
+	cert, err := LoadCertificate(dir)
+	if err != nil {
+		return err
+	}
+	serverTLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	// Peers use self-signed certificates, they are checked against
+	// the pins instead of a CA.
+	clientTLS = &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	}
+	Pins = LoadPins(path.Join(dir, PinsFile))
+	return nil
+}
+
+func LoadCertificate(dir string) (tls.Certificate, error) {
+	certPath := path.Join(dir, CertFile)
+	keyPath := path.Join(dir, KeyFile)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil {
+		return cert, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return cert, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return cert, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "JG Sender"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(20, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return cert, err
+	}
+	bkey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return cert, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: bkey})
+
+	os.MkdirAll(dir, 0777)
+	err = ioutil.WriteFile(keyPath, keyPEM, 0600)
+	if err != nil {
+		return cert, err
+	}
+	err = ioutil.WriteFile(certPath, certPEM, 0644)
+	if err != nil {
+		return cert, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func peerFingerprint(connection net.Conn) string {
+	tc, ok := connection.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return Fingerprint(certs[0])
+}
+
+// channelBinding exports the keying material of the TLS session, it is
+// the same on both ends and only there.
+func channelBinding(connection net.Conn) ([]byte, error) {
+	tc, ok := connection.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	state := tc.ConnectionState()
+	return state.ExportKeyingMaterial(BindingLabel, nil, BindingSize)
+}
+
+// pin is what a device showed on first contact: the fingerprint of its
+// certificate and its Ed25519 key.
+type pin struct {
+	Cert string
+	Key  []byte `json:",omitempty"`
+}
+
+// PinStore maps device IDs to the certificate and key seen on first
+// contact (trust on first use).
+type PinStore struct {
+	mu   sync.Mutex
+	file string
+	pins map[string]pin
+}
+
+func LoadPins(file string) *PinStore {
+	store := &PinStore{
+		file: file,
+		pins: map[string]pin{},
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return store
+	}
+	err = json.Unmarshal(buf, &store.pins)
+	if err != nil {
+		// Pins saved before the keys only have the fingerprint
+		certs := map[string]string{}
+		json.Unmarshal(buf, &certs)
+		store.pins = map[string]pin{}
+		for id, cert := range certs {
+			store.pins[id] = pin{Cert: cert}
+		}
+	}
+	return store
+}
+
+// Known tells if id was pinned.
+func (p *PinStore) Known(id string) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.pins[id]
+	return ok
+}
+
+func (p *PinStore) save() error {
+	buf, err := json.Marshal(p.pins)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p.file, buf, 0600)
+}
+
+// Check pins fingerprint and key to id if it is the first contact,
+// otherwise it fails when either changed. The first contact needs the
+// key the peer signed with, a pin saved without one takes it.
+func (p *PinStore) Check(id, fingerprint string, key []byte) error {
+	if fingerprint == "" {
+		return ErrPinMismatch
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old, ok := p.pins[id]
+	if !ok {
+		if key == nil {
+			return ErrUnverified
+		}
+		p.pins[id] = pin{Cert: fingerprint, Key: key}
+		return p.save()
+	}
+	if old.Cert != fingerprint {
+		return ErrPinMismatch
+	}
+	if key == nil {
+		return nil
+	}
+	if old.Key == nil {
+		old.Key = key
+		p.pins[id] = old
+		return p.save()
+	}
+	if !bytes.Equal(old.Key, key) {
+		return ErrPinMismatch
+	}
+	return nil
+}
+
+// Forget drops the pin of id, the next contact pins it again.
+func (p *PinStore) Forget(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pins, id)
+	return p.save()
+}
@@ -13,6 +13,24 @@ const (
 	OK
 	ERROR
 	CANCELED
+
+	PAIR
+	DENIED
+
+	// Data phase of RESOURCES, see flow.go
+	DATA
+	CREDIT
+
+	// Parallel streams, see streams.go
+	STREAM
+	RANGE
+	DONE
+
+	// Compressed DATA, see compress.go
+	ZDATA
+
+	// Delta transfers, see delta.go
+	COPY
 )
 
 var CTL = []byte{0, 2, 0, 8, 2, 0, 0, 0}
@@ -3,11 +3,18 @@ module github.com/julioguillermo/jg_sender
 go 1.18
 
 require (
-	gioui.org v0.0.0-20220718084447-e711cbc004b2 // indirect
+	gioui.org v0.0.0-20220718084447-e711cbc004b2
+	gioui.org/x v0.0.0-20220711203002-4d04c4f9ff66
+	github.com/google/uuid v1.3.0
+	golang.org/x/net v0.0.0-20210805182204-aaa1db679c0d
+	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c
+	golang.org/x/text v0.3.7
+)
+
+require (
 	gioui.org/cpu v0.0.0-20210817075930-8d6a761490d2 // indirect
 	//gioui.org/example v0.0.0-20220630144041-171a6b4847f1 // indirect
 	gioui.org/shader v1.0.6 // indirect
-	gioui.org/x v0.0.0-20220711203002-4d04c4f9ff66 // indirect
 	git.wow.st/gmp/jni v0.0.0-20210610011705-34026c7e22d0 // indirect
 	github.com/benoitkugler/textlayout v0.1.1 // indirect
 	github.com/esiqveland/notify v0.11.0 // indirect
@@ -15,10 +22,7 @@ require (
 	github.com/go-text/typesetting v0.0.0-20220411150340-35994bc27a7b // indirect
 	github.com/go-toast/toast v0.0.0-20190211030409-01e6764cf0a4 // indirect
 	github.com/godbus/dbus/v5 v5.0.6 // indirect
-	github.com/google/uuid v1.3.0 // indirect
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d // indirect
 	golang.org/x/exp v0.0.0-20210722180016-6781d3edade3 // indirect
 	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d // indirect
-	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
-	golang.org/x/text v0.3.7 // indirect
 )
@@ -32,6 +32,9 @@ type DirDialog struct {
 	elements []*storage.Element
 
 	onOpen func(string)
+
+	// OnClose is called when the dialog is closed without a selection.
+	OnClose func()
 }
 
 func NewDirDialog(dir string, onOpen func(string)) *DirDialog {
@@ -192,6 +195,9 @@ func (p *DirDialog) Layout(th *material.Theme, gtx layout.Context, w *app.Window
 
 	if p.close.Clicked() {
 		conf.CloseDialog()
+		if p.OnClose != nil {
+			p.OnClose()
+		}
 	}
 
 	return dim
@@ -49,7 +49,7 @@ func NewFileDialog(userID string, sendRes func(userID string, resources []string
 }
 
 func (p *FileDialog) Layout(th *material.Theme, gtx layout.Context, w *app.Window, conf *config.Config) layout.Dimensions {
-	device := connection.GetDevice(p.userid)
+	device := connection.Records.Device(p.userid)
 	addr := ""
 	name := "Unknown"
 	if device != nil {
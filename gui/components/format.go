@@ -0,0 +1,24 @@
+package components
+
+import "fmt"
+
+func FormatSize(size float64) string {
+	const (
+		b  = 1024.0
+		kb = b * b
+		mb = b * kb
+	)
+	switch {
+	case size > mb:
+		size /= mb
+		return fmt.Sprintf("%.2f GB", size)
+	case size > kb:
+		size /= kb
+		return fmt.Sprintf("%.2f MB", size)
+	case size > b:
+		size /= b
+		return fmt.Sprintf("%.2f KB", size)
+	default:
+		return fmt.Sprintf("%.2f B", size)
+	}
+}
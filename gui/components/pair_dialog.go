@@ -0,0 +1,135 @@
+package components
+
+import (
+	"gioui.org/app"
+	"gioui.org/layout"
+	"gioui.org/text"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/julioguillermo/jg_sender/config"
+)
+
+type PairDialog struct {
+	title string
+	text  string
+	input *TextInput
+
+	ok    widget.Clickable
+	close widget.Clickable
+
+	onClose func(string, bool)
+	closed  bool
+}
+
+// NewPairDialog shows text, e.g. the pairing code or the pairing result.
+func NewPairDialog(title, text string, onClose func(string, bool)) *PairDialog {
+	return &PairDialog{
+		title:   title,
+		text:    text,
+		onClose: onClose,
+	}
+}
+
+// NewInputDialog asks for a line of text, validator may be nil.
+func NewInputDialog(title, text, hint string, validator func(string) bool, onClose func(string, bool)) *PairDialog {
+	diag := NewPairDialog(title, text, onClose)
+	diag.input = NewTextInput(hint, false)
+	diag.input.Validator = validator
+	return diag
+}
+
+// NewPairInputDialog asks for the code shown by the other device.
+func NewPairInputDialog(title string, onClose func(string, bool)) *PairDialog {
+	return NewInputDialog(title, "Type the code shown on the other device", "Code", func(s string) bool {
+		if s == "" {
+			return false
+		}
+		for _, r := range s {
+			if r < '0' || r > '9' {
+				return false
+			}
+		}
+		return true
+	}, onClose)
+}
+
+func (p *PairDialog) finish(conf *config.Config, code string, ok bool) {
+	if p.closed {
+		return
+	}
+	p.closed = true
+	conf.CloseDialog()
+	if p.onClose != nil {
+		p.onClose(code, ok)
+	}
+}
+
+func (p *PairDialog) Layout(th *material.Theme, gtx layout.Context, w *app.Window, conf *config.Config) layout.Dimensions {
+	if gtx.Constraints.Max.X > gtx.Dp(400) {
+		gtx.Constraints.Max.X = gtx.Dp(400)
+	}
+	if p.close.Clicked() {
+		p.finish(conf, "", false)
+	} else if p.input != nil && p.ok.Clicked() && p.input.Text() != "" {
+		p.finish(conf, p.input.Text(), true)
+	}
+
+	return layout.Flex{
+		Axis: layout.Vertical,
+	}.Layout(
+		gtx,
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			return layout.Flex{
+				Axis: layout.Horizontal,
+			}.Layout(
+				gtx,
+				layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+					to := material.Label(th, 20, p.title)
+					to.Color = conf.BGPrimaryColor
+					return to.Layout(gtx)
+				}),
+				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+					bls := material.ButtonLayout(th, &p.close)
+					bls.Background = conf.BGColor
+					bls.CornerRadius = 15
+					return bls.Layout(
+						gtx,
+						func(gtx layout.Context) layout.Dimensions {
+							return NewIcon(th, gtx, config.ICClose, conf.DangerColor, 30)
+						},
+					)
+				}),
+			)
+		}),
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			return layout.UniformInset(10).Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+				if p.input != nil {
+					return material.Label(th, th.TextSize, p.text).Layout(gtx)
+				}
+				lab := material.Label(th, th.TextSize*1.5, p.text)
+				lab.Font.Weight = text.Bold
+				lab.Alignment = text.Middle
+				return lab.Layout(gtx)
+			})
+		}),
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			if p.input == nil {
+				return layout.Dimensions{}
+			}
+			return layout.Flex{
+				Axis:      layout.Horizontal,
+				Alignment: layout.End,
+			}.Layout(
+				gtx,
+				layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+					return p.input.Layout(th, gtx, w, conf)
+				}),
+				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+					return material.Clickable(gtx, &p.ok, func(gtx layout.Context) layout.Dimensions {
+						return NewIcon(th, gtx, config.ICOK, conf.BGPrimaryColor, 40)
+					})
+				}),
+			)
+		}),
+	)
+}
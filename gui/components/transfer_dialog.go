@@ -0,0 +1,191 @@
+package components
+
+import (
+	"fmt"
+
+	"gioui.org/app"
+	"gioui.org/layout"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/julioguillermo/jg_sender/config"
+	"github.com/julioguillermo/jg_sender/config/storage"
+	"github.com/julioguillermo/jg_sender/connection"
+)
+
+// TransferDialog shows an incoming transfer and lets the user accept it,
+// accept it to another folder or reject it. A delta transfer replaces
+// the files of the same name in the folder, existing of them, unless
+// the user unchecks replace.
+type TransferDialog struct {
+	sender   string
+	files    []*connection.Element
+	total    uint64
+	dir      string
+	free     uint64
+	err      error
+	delta    bool
+	existing int
+
+	replace widget.Bool
+	accept  widget.Clickable
+	another widget.Clickable
+	reject  widget.Clickable
+	close   widget.Clickable
+	list    widget.List
+
+	onClose func(dir string, replace, ok bool)
+	closed  bool
+}
+
+func NewTransferDialog(sender, dir string, files []*connection.Element, total uint64, delta bool, onClose func(string, bool, bool)) *TransferDialog {
+	diag := &TransferDialog{
+		sender:  sender,
+		files:   files,
+		total:   total,
+		delta:   delta,
+		onClose: onClose,
+	}
+	diag.replace.Value = delta
+	diag.list.List.Axis = layout.Vertical
+	diag.setDir(dir)
+	return diag
+}
+
+func (p *TransferDialog) setDir(dir string) {
+	p.dir = dir
+	p.free, p.err = storage.FreeSpace(dir)
+	p.existing = 0
+	if !p.delta {
+		return
+	}
+	for _, file := range p.files {
+		dst, err := connection.InboxPath(dir, file.Name)
+		if err == nil && connection.FileExist(dst) {
+			p.existing++
+		}
+	}
+}
+
+func (p *TransferDialog) finish(conf *config.Config, ok bool) {
+	if p.closed {
+		return
+	}
+	p.closed = true
+	conf.CloseDialog()
+	if p.onClose != nil {
+		p.onClose(p.dir, p.delta && p.replace.Value, ok)
+	}
+}
+
+func (p *TransferDialog) Layout(th *material.Theme, gtx layout.Context, w *app.Window, conf *config.Config) layout.Dimensions {
+	if gtx.Constraints.Max.X > gtx.Dp(400) {
+		gtx.Constraints.Max.X = gtx.Dp(400)
+	}
+	if gtx.Constraints.Max.Y > gtx.Dp(500) {
+		gtx.Constraints.Max.Y = gtx.Dp(500)
+	}
+	if p.close.Clicked() || p.reject.Clicked() {
+		p.finish(conf, false)
+	} else if p.accept.Clicked() {
+		p.finish(conf, true)
+	} else if p.another.Clicked() {
+		dirDiag := NewDirDialog(p.dir, func(s string) {
+			p.setDir(s)
+			conf.OpenDialog(p.Layout)
+		})
+		dirDiag.OnClose = func() {
+			conf.OpenDialog(p.Layout)
+		}
+		conf.OpenDialog(dirDiag.Layout)
+	}
+
+	return layout.Flex{
+		Axis: layout.Vertical,
+	}.Layout(
+		gtx,
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			return layout.Flex{
+				Axis: layout.Horizontal,
+			}.Layout(
+				gtx,
+				layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+					to := material.Label(th, 20, "Files from "+p.sender)
+					to.Color = conf.BGPrimaryColor
+					return to.Layout(gtx)
+				}),
+				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+					bls := material.ButtonLayout(th, &p.close)
+					bls.Background = conf.BGColor
+					bls.CornerRadius = 15
+					return bls.Layout(
+						gtx,
+						func(gtx layout.Context) layout.Dimensions {
+							return NewIcon(th, gtx, config.ICClose, conf.DangerColor, 30)
+						},
+					)
+				}),
+			)
+		}),
+		layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+			return material.List(th, &p.list).Layout(
+				gtx,
+				len(p.files),
+				func(gtx layout.Context, index int) layout.Dimensions {
+					file := p.files[index]
+					return layout.Flex{
+						Axis: layout.Horizontal,
+					}.Layout(
+						gtx,
+						layout.Flexed(1, material.Label(th, th.TextSize, file.Name).Layout),
+						layout.Rigid(material.Label(th, th.TextSize*0.8, FormatSize(float64(file.Size))).Layout),
+					)
+				},
+			)
+		}),
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			return layout.Inset{Top: 10}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+				txt := fmt.Sprintf("%d files, %s", len(p.files), FormatSize(float64(p.total)))
+				return material.Label(th, th.TextSize, txt).Layout(gtx)
+			})
+		}),
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			txt := fmt.Sprintf("%s free in %s", FormatSize(float64(p.free)), p.dir)
+			if p.err != nil {
+				txt = p.err.Error()
+			}
+			lab := material.Label(th, th.TextSize*0.8, txt)
+			if p.err != nil || p.free < p.total {
+				lab.Color = conf.DangerColor
+			}
+			return lab.Layout(gtx)
+		}),
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			if !p.delta {
+				return layout.Dimensions{}
+			}
+			txt := fmt.Sprintf("Replace the files of the same name, %d in this folder", p.existing)
+			box := material.CheckBox(th, &p.replace, txt)
+			if p.replace.Value && p.existing > 0 {
+				box.Color = conf.DangerColor
+			}
+			return box.Layout(gtx)
+		}),
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			return layout.Inset{Top: 10}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+				return layout.Flex{
+					Axis:    layout.Horizontal,
+					Spacing: layout.SpaceBetween,
+				}.Layout(
+					gtx,
+					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+						btn := material.Button(th, &p.reject, "Reject")
+						btn.Background = conf.DangerColor
+						return btn.Layout(gtx)
+					}),
+					layout.Rigid(material.Button(th, &p.another, "Another folder").Layout),
+					layout.Rigid(material.Button(th, &p.accept, "Accept").Layout),
+				)
+			})
+		}),
+	)
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"net"
+	"net/netip"
 	"os"
 	"strconv"
 	"time"
@@ -28,12 +30,33 @@ type ConfigUI struct {
 	Connections *components.TextInput
 	Timeout     *components.TextInput
 	BufSize     *components.TextInput
+	Streams     *components.TextInput
 	AnimTime    *components.TextInput
 
+	ConnectTimeout *components.TextInput
+	IdleTimeout    *components.TextInput
+	StallTimeout   *components.TextInput
+
+	ListenAddr      *components.TextInput
+	ListenInterface *components.TextInput
+	ListenPort      *components.TextInput
+
+	MaxID       *components.TextInput
+	MaxName     *components.TextInput
+	MaxMSG      *components.TextInput
+	MaxFiles    *components.TextInput
+	MaxFileName *components.TextInput
+	MaxBufSize  *components.TextInput
+	MaxManifest *components.TextInput
+
 	reset     widget.Clickable
 	openInbox widget.Clickable
 	list      widget.List
 
+	unpaired widget.Enum
+	compress widget.Enum
+	untrust  map[string]*widget.Clickable
+
 	appbar *component.AppBar
 	card   *components.Card
 
@@ -61,6 +84,22 @@ func CheckNum(s string) bool {
 	return true
 }
 
+func CheckLimit(s string) bool {
+	if !CheckNum(s) {
+		return false
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	return err == nil && n > 0
+}
+
+func CheckPort(s string) bool {
+	if !CheckNum(s) {
+		return false
+	}
+	n, err := strconv.ParseUint(s, 10, 16)
+	return err == nil && n > 0
+}
+
 func NewConfigScreen(c *config.Config) *ConfigUI {
 	conf := &ConfigUI{
 		Conf: c,
@@ -69,10 +108,28 @@ func NewConfigScreen(c *config.Config) *ConfigUI {
 		Inbox:       components.NewTextInput("Inbox", false),
 		Connections: components.NewTextInput("Connections", false),
 		Timeout:     components.NewTextInput("Timeout (ms)", false),
-		BufSize:     components.NewTextInput("Buffer size", false),
+		BufSize:     components.NewTextInput(fmt.Sprintf("Max chunk size (at least %d)", config.MinBufSize), false),
+		Streams:     components.NewTextInput("Parallel streams", false),
 		AnimTime:    components.NewTextInput("Animation time (ms)", false),
 
-		card: components.NewSimpleCard(c.BGColor, 20, 10, 10),
+		ConnectTimeout: components.NewTextInput("Connect timeout (ms)", false),
+		IdleTimeout:    components.NewTextInput("Answer timeout (ms)", false),
+		StallTimeout:   components.NewTextInput("Stalled transfer timeout (ms)", false),
+
+		ListenAddr:      components.NewTextInput("Listen address (restart, empty for all)", false),
+		ListenInterface: components.NewTextInput("Listen interface (restart, empty for all)", false),
+		ListenPort:      components.NewTextInput("Listen port (restart)", false),
+
+		MaxID:       components.NewTextInput("Max ID length", false),
+		MaxName:     components.NewTextInput("Max device name length", false),
+		MaxMSG:      components.NewTextInput("Max message size", false),
+		MaxFiles:    components.NewTextInput("Max files per transfer", false),
+		MaxFileName: components.NewTextInput("Max file name length", false),
+		MaxBufSize:  components.NewTextInput("Max peer buffer size", false),
+		MaxManifest: components.NewTextInput("Max file names per transfer (bytes)", false),
+
+		card:    components.NewSimpleCard(c.BGColor, 20, 10, 10),
+		untrust: map[string]*widget.Clickable{},
 	}
 
 	modal := component.NewModal()
@@ -109,8 +166,9 @@ func NewConfigScreen(c *config.Config) *ConfigUI {
 			return false
 		}
 		bsize, err := strconv.ParseUint(s, 10, 64)
-		return err == nil && bsize > 1
+		return err == nil && bsize >= config.MinBufSize
 	}
+	conf.Streams.Validator = CheckLimit
 	conf.AnimTime.Validator = func(s string) bool {
 		if !CheckNum(s) {
 			return false
@@ -118,6 +176,31 @@ func NewConfigScreen(c *config.Config) *ConfigUI {
 		_, err := strconv.ParseUint(s, 10, 64)
 		return err == nil
 	}
+	conf.ConnectTimeout.Validator = CheckLimit
+	conf.IdleTimeout.Validator = CheckLimit
+	conf.StallTimeout.Validator = CheckLimit
+	conf.ListenAddr.Validator = func(s string) bool {
+		if s == "" {
+			return true
+		}
+		_, err := netip.ParseAddr(s)
+		return err == nil
+	}
+	conf.ListenInterface.Validator = func(s string) bool {
+		if s == "" {
+			return true
+		}
+		_, err := net.InterfaceByName(s)
+		return err == nil
+	}
+	conf.ListenPort.Validator = CheckPort
+	conf.MaxID.Validator = CheckLimit
+	conf.MaxName.Validator = CheckLimit
+	conf.MaxMSG.Validator = CheckLimit
+	conf.MaxFiles.Validator = CheckLimit
+	conf.MaxFileName.Validator = CheckLimit
+	conf.MaxBufSize.Validator = CheckLimit
+	conf.MaxManifest.Validator = CheckLimit
 	conf.list.List.Axis = layout.Vertical
 
 	conf.Load()
@@ -131,7 +214,23 @@ func (p *ConfigUI) Load() {
 	p.Connections.SetText(fmt.Sprint(p.Conf.Connections()))
 	p.Timeout.SetText(fmt.Sprint(p.Conf.Timeout()))
 	p.BufSize.SetText(fmt.Sprint(p.Conf.BufSize()))
+	p.Streams.SetText(fmt.Sprint(p.Conf.Streams()))
 	p.AnimTime.SetText(fmt.Sprint(p.Conf.C_AnimTime))
+	p.unpaired.Value = fmt.Sprint(p.Conf.Unpaired())
+	p.compress.Value = fmt.Sprint(p.Conf.Compress())
+	p.ConnectTimeout.SetText(fmt.Sprint(p.Conf.ConnectTimeout().Milliseconds()))
+	p.IdleTimeout.SetText(fmt.Sprint(p.Conf.IdleTimeout().Milliseconds()))
+	p.StallTimeout.SetText(fmt.Sprint(p.Conf.StallTimeout().Milliseconds()))
+	p.ListenAddr.SetText(p.Conf.ListenAddr())
+	p.ListenInterface.SetText(p.Conf.ListenInterface())
+	p.ListenPort.SetText(fmt.Sprint(p.Conf.ListenPort()))
+	p.MaxID.SetText(fmt.Sprint(p.Conf.MaxID()))
+	p.MaxName.SetText(fmt.Sprint(p.Conf.MaxName()))
+	p.MaxMSG.SetText(fmt.Sprint(p.Conf.MaxMSG()))
+	p.MaxFiles.SetText(fmt.Sprint(p.Conf.MaxFiles()))
+	p.MaxFileName.SetText(fmt.Sprint(p.Conf.MaxFileName()))
+	p.MaxBufSize.SetText(fmt.Sprint(p.Conf.MaxBufSize()))
+	p.MaxManifest.SetText(fmt.Sprint(p.Conf.MaxManifest()))
 }
 
 func (p *ConfigUI) Layout(th *material.Theme, gtx layout.Context, w *app.Window, conf *config.Config) layout.Dimensions {
@@ -166,10 +265,60 @@ func (p *ConfigUI) Layout(th *material.Theme, gtx layout.Context, w *app.Window,
 	} else if p.BufSize.Changed() {
 		if CheckNum(p.BufSize.Text()) {
 			bufsize, err := strconv.ParseUint(p.BufSize.Text(), 10, 64)
-			if err == nil && bufsize > 1 {
+			if err == nil && bufsize >= config.MinBufSize {
 				p.Conf.SetBufSize(bufsize)
 			}
 		}
+	} else if p.Streams.Changed() && p.Streams.Valid() {
+		n, _ := strconv.ParseUint(p.Streams.Text(), 10, 64)
+		p.Conf.SetStreams(n)
+	} else if p.ConnectTimeout.Changed() && p.ConnectTimeout.Valid() {
+		n, _ := strconv.ParseUint(p.ConnectTimeout.Text(), 10, 64)
+		p.Conf.SetConnectTimeout(n)
+	} else if p.IdleTimeout.Changed() && p.IdleTimeout.Valid() {
+		n, _ := strconv.ParseUint(p.IdleTimeout.Text(), 10, 64)
+		p.Conf.SetIdleTimeout(n)
+	} else if p.StallTimeout.Changed() && p.StallTimeout.Valid() {
+		n, _ := strconv.ParseUint(p.StallTimeout.Text(), 10, 64)
+		p.Conf.SetStallTimeout(n)
+	} else if p.ListenAddr.Changed() && p.ListenAddr.Valid() {
+		p.Conf.SetListenAddr(p.ListenAddr.Text())
+	} else if p.ListenInterface.Changed() && p.ListenInterface.Valid() {
+		p.Conf.SetListenInterface(p.ListenInterface.Text())
+	} else if p.ListenPort.Changed() && p.ListenPort.Valid() {
+		n, _ := strconv.ParseUint(p.ListenPort.Text(), 10, 64)
+		p.Conf.SetListenPort(n)
+	} else if p.MaxID.Changed() && p.MaxID.Valid() {
+		n, _ := strconv.ParseUint(p.MaxID.Text(), 10, 64)
+		p.Conf.SetMaxID(n)
+	} else if p.MaxName.Changed() && p.MaxName.Valid() {
+		n, _ := strconv.ParseUint(p.MaxName.Text(), 10, 64)
+		p.Conf.SetMaxName(n)
+	} else if p.MaxMSG.Changed() && p.MaxMSG.Valid() {
+		n, _ := strconv.ParseUint(p.MaxMSG.Text(), 10, 64)
+		p.Conf.SetMaxMSG(n)
+	} else if p.MaxFiles.Changed() && p.MaxFiles.Valid() {
+		n, _ := strconv.ParseUint(p.MaxFiles.Text(), 10, 64)
+		p.Conf.SetMaxFiles(n)
+	} else if p.MaxFileName.Changed() && p.MaxFileName.Valid() {
+		n, _ := strconv.ParseUint(p.MaxFileName.Text(), 10, 64)
+		p.Conf.SetMaxFileName(n)
+	} else if p.MaxBufSize.Changed() && p.MaxBufSize.Valid() {
+		n, _ := strconv.ParseUint(p.MaxBufSize.Text(), 10, 64)
+		p.Conf.SetMaxBufSize(n)
+	} else if p.MaxManifest.Changed() && p.MaxManifest.Valid() {
+		n, _ := strconv.ParseUint(p.MaxManifest.Text(), 10, 64)
+		p.Conf.SetMaxManifest(n)
+	} else if p.unpaired.Changed() {
+		policy, err := strconv.ParseUint(p.unpaired.Value, 10, 64)
+		if err == nil {
+			p.Conf.SetUnpaired(policy)
+		}
+	} else if p.compress.Changed() {
+		mode, err := strconv.ParseUint(p.compress.Value, 10, 64)
+		if err == nil {
+			p.Conf.SetCompress(mode)
+		}
 	} else if p.AnimTime.Changed() {
 		if CheckNum(p.AnimTime.Text()) {
 			atime, err := strconv.ParseUint(p.AnimTime.Text(), 10, 64)
@@ -246,7 +395,30 @@ func (p *ConfigUI) Layout(th *material.Theme, gtx layout.Context, w *app.Window,
 								p.GetConfigItem(th, w, conf, p.Connections.Layout),
 								p.GetConfigItem(th, w, conf, p.Timeout.Layout),
 								p.GetConfigItem(th, w, conf, p.BufSize.Layout),
+								p.GetConfigItem(th, w, conf, p.Streams.Layout),
+								p.GetConfigItem(th, w, conf, p.RenderCompress),
 								p.GetConfigItem(th, w, conf, p.AnimTime.Layout),
+								p.GetConfigItem(th, w, conf, p.ConnectTimeout.Layout),
+								p.GetConfigItem(th, w, conf, p.IdleTimeout.Layout),
+								p.GetConfigItem(th, w, conf, p.StallTimeout.Layout),
+
+								// Server
+								p.GetConfigItem(th, w, conf, p.ListenAddr.Layout),
+								p.GetConfigItem(th, w, conf, p.ListenInterface.Layout),
+								p.GetConfigItem(th, w, conf, p.ListenPort.Layout),
+
+								// Pairing
+								p.GetConfigItem(th, w, conf, p.RenderUnpaired),
+								p.GetConfigItem(th, w, conf, p.RenderTrusted),
+
+								// Limits for peers
+								p.GetConfigItem(th, w, conf, p.MaxID.Layout),
+								p.GetConfigItem(th, w, conf, p.MaxName.Layout),
+								p.GetConfigItem(th, w, conf, p.MaxMSG.Layout),
+								p.GetConfigItem(th, w, conf, p.MaxFiles.Layout),
+								p.GetConfigItem(th, w, conf, p.MaxFileName.Layout),
+								p.GetConfigItem(th, w, conf, p.MaxBufSize.Layout),
+								p.GetConfigItem(th, w, conf, p.MaxManifest.Layout),
 
 								// Theme config
 								// Main colors
@@ -443,6 +615,81 @@ func (p *ConfigUI) RenderColor(th *material.Theme, w *app.Window, conf *config.C
 	})
 }
 
+func (p *ConfigUI) RenderUnpaired(th *material.Theme, gtx layout.Context, w *app.Window, conf *config.Config) layout.Dimensions {
+	return layout.Flex{
+		Axis: layout.Vertical,
+	}.Layout(
+		gtx,
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			lab := material.Label(th, th.TextSize, "Unpaired devices can send")
+			lab.Color = conf.BGPrimaryColor
+			return lab.Layout(gtx)
+		}),
+		layout.Rigid(material.RadioButton(th, &p.unpaired, fmt.Sprint(config.UnpairedMessages), "Messages only").Layout),
+		layout.Rigid(material.RadioButton(th, &p.unpaired, fmt.Sprint(config.UnpairedAll), "Messages and files").Layout),
+		layout.Rigid(material.RadioButton(th, &p.unpaired, fmt.Sprint(config.UnpairedNothing), "Nothing").Layout),
+	)
+}
+
+func (p *ConfigUI) RenderCompress(th *material.Theme, gtx layout.Context, w *app.Window, conf *config.Config) layout.Dimensions {
+	return layout.Flex{
+		Axis: layout.Vertical,
+	}.Layout(
+		gtx,
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			lab := material.Label(th, th.TextSize, "Compress files on the wire")
+			lab.Color = conf.BGPrimaryColor
+			return lab.Layout(gtx)
+		}),
+		layout.Rigid(material.RadioButton(th, &p.compress, fmt.Sprint(config.CompressNone), "Off").Layout),
+		layout.Rigid(material.RadioButton(th, &p.compress, fmt.Sprint(config.CompressDeflate), "Deflate, skips compressed files").Layout),
+	)
+}
+
+func (p *ConfigUI) RenderTrusted(th *material.Theme, gtx layout.Context, w *app.Window, conf *config.Config) layout.Dimensions {
+	trusted := conf.TrustedDevices()
+	children := []layout.FlexChild{
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			lab := material.Label(th, th.TextSize, "Paired devices")
+			lab.Color = conf.BGPrimaryColor
+			return lab.Layout(gtx)
+		}),
+	}
+	if len(trusted) == 0 {
+		children = append(children, layout.Rigid(material.Label(th, th.TextSize*0.7, "Open a conversation and pair to trust a device").Layout))
+	}
+	for _, t := range trusted {
+		dev := t
+		click := p.untrust[dev.ID]
+		if click == nil {
+			click = &widget.Clickable{}
+			p.untrust[dev.ID] = click
+		}
+		if click.Clicked() {
+			conf.Untrust(dev.ID)
+		}
+		children = append(children, layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			return layout.Flex{
+				Axis:      layout.Horizontal,
+				Alignment: layout.Middle,
+			}.Layout(
+				gtx,
+				layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+					return material.Label(th, th.TextSize, dev.Name).Layout(gtx)
+				}),
+				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+					return material.Clickable(gtx, click, func(gtx layout.Context) layout.Dimensions {
+						return components.NewIcon(th, gtx, config.ICClose, conf.DangerColor, 30)
+					})
+				}),
+			)
+		}))
+	}
+	return layout.Flex{
+		Axis: layout.Vertical,
+	}.Layout(gtx, children...)
+}
+
 func (p *ConfigUI) InAnim() {
 	p.anim.Duration = p.Conf.AnimTime()
 	p.anim.Start(time.Now())
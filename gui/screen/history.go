@@ -1,9 +1,12 @@
 package screen
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
+	"sync"
 	"time"
 
 	"gioui.org/app"
@@ -44,6 +47,11 @@ type History struct {
 	entry    widget.Editor
 	send     widget.Clickable
 	openFile widget.Clickable
+	pair     widget.Clickable
+	rename   widget.Clickable
+	status   widget.Clickable
+	favorite widget.Clickable
+	delta    widget.Clickable
 	card     *components.Card
 
 	loading_anim *components.LoadingAnim
@@ -51,10 +59,26 @@ type History struct {
 	visible      bool
 	closing      bool
 
+	// Dialogs the server asks for are queued and shown one at a time
+	// from Layout, shown is the one open.
+	dialogs  sync.Mutex
+	pending  []*modal
+	shown    *modal
+	pairCode *modal
+
 	SendMSG       func(string, string)
 	SendRes       func(string, []string)
+	SendDelta     func(string, []string)
 	SendView      func(string)
-	ContinueTrans func(string, *connection.Transfer)
+	ContinueTrans func(string, string)
+	Pair          func(string)
+}
+
+// modal is a dialog queued by the server, it is dropped or closed once
+// expired.
+type modal struct {
+	layout  func(*material.Theme, layout.Context, *app.Window, *config.Config) layout.Dimensions
+	expired bool
 }
 
 type InboxItem struct {
@@ -80,35 +104,51 @@ func NewHistoryScreen(th *material.Theme, conf *config.Config, w *app.Window) *H
 			return components.NewIcon(th, gtx, config.ICBack, conf.FGPrimaryColor, ScreenBarHeight)
 		})
 	}
+	appbar.SetActions([]component.AppBarAction{{
+		// Follows the presence of the peer
+		OverflowAction: component.OverflowAction{
+			Name: "Status",
+			Tag:  &history.status,
+		},
+		Layout: func(gtx layout.Context, bg, fg color.NRGBA) layout.Dimensions {
+			ic := config.ICOffline
+			dev := connection.Records.Device(history.UserID)
+			if dev != nil && dev.Online {
+				ic = config.ICOnline
+			}
+			return components.NewIcon(th, gtx, ic, conf.FGPrimaryColor, ScreenBarHeight)
+		},
+	}, {
+		OverflowAction: component.OverflowAction{
+			Name: "Pair",
+			Tag:  &history.pair,
+		},
+		Layout: func(gtx layout.Context, bg, fg color.NRGBA) layout.Dimensions {
+			bls := material.ButtonLayout(th, &history.pair)
+			bls.CornerRadius = ScreenBarHeight / 2
+			return bls.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+				return components.NewIcon(th, gtx, config.ICPair, conf.FGPrimaryColor, ScreenBarHeight)
+			})
+		},
+	}}, []component.OverflowAction{{
+		Name: "Rename",
+		Tag:  &history.rename,
+	}, {
+		Name: "Favorite ON/OFF",
+		Tag:  &history.favorite,
+	}, {
+		// Only what changed against the copies the peer has
+		Name: "Send updates (delta)",
+		Tag:  &history.delta,
+	}})
 	history.appbar = appbar
 
 	history.list.List.Axis = layout.Vertical
 	return history
 }
 
-func formatSize(size float64) string {
-	const (
-		b  = 1024.0
-		kb = b * b
-		mb = b * kb
-	)
-	switch {
-	case size > mb:
-		size /= mb
-		return fmt.Sprintf("%.2f GB", size)
-	case size > kb:
-		size /= kb
-		return fmt.Sprintf("%.2f MB", size)
-	case size > b:
-		size /= b
-		return fmt.Sprintf("%.2f KB", size)
-	default:
-		return fmt.Sprintf("%.2f B", size)
-	}
-}
-
-func (p *History) Update(UserID string) {
-	if p.visible && p.UserID == UserID {
+func (p *History) OnEvent(e connection.Event) {
+	if p.visible && (e.UserID == p.UserID || e.Kind == connection.DevicesInvalidated) {
 		p.win.Invalidate()
 	}
 }
@@ -117,10 +157,9 @@ func (p *History) Open(id string) {
 	if p.SendView != nil {
 		go p.SendView(id)
 	}
-	dev := connection.GetDevice(id)
-	if dev != nil {
+	connection.Records.UpdateDevice(id, func(dev *connection.Device) {
 		dev.Not = 0
-	}
+	})
 	p.closing = false
 	p.visible = true
 	p.anim.Duration = p.conf.AnimTime()
@@ -148,6 +187,7 @@ func (p *History) Visibility() bool {
 }
 
 func (p *History) Layout(th *material.Theme, gtx layout.Context) layout.Dimensions {
+	p.showDialog()
 	if p.appbar.NavigationButton.Clicked() {
 		p.Close()
 	}
@@ -162,6 +202,28 @@ func (p *History) Layout(th *material.Theme, gtx layout.Context) layout.Dimensio
 		return layout.Dimensions{}
 	}
 
+	for _, e := range p.appbar.Events(gtx) {
+		t, ok := e.(component.AppBarOverflowActionClicked)
+		if ok && t.Tag == &p.pair && p.Pair != nil {
+			go p.Pair(p.UserID)
+		}
+		if ok && t.Tag == &p.rename {
+			p.askAlias(p.UserID)
+		}
+		if ok && t.Tag == &p.favorite {
+			connection.Records.UpdateDevice(p.UserID, func(dev *connection.Device) {
+				dev.Favorite = !dev.Favorite
+			})
+		}
+		if ok && t.Tag == &p.delta {
+			diag := components.NewFileDialog(p.UserID, p.SendDelta)
+			p.conf.OpenDialog(diag.Layout)
+		}
+	}
+	if p.pair.Clicked() && p.Pair != nil {
+		go p.Pair(p.UserID)
+	}
+
 	if p.send.Clicked() && p.SendMSG != nil && p.entry.Text() != "" {
 		go p.SendMSG(p.UserID, p.entry.Text())
 		p.entry.SetText("")
@@ -182,11 +244,11 @@ func (p *History) Layout(th *material.Theme, gtx layout.Context) layout.Dimensio
 	}
 	paint.FillShape(gtx.Ops, p.conf.ScreenColor, rec.Op())
 
-	History := connection.GetUserHistory(p.UserID)
+	History := connection.Records.History(p.UserID)
 
-	dev := connection.GetDevice(p.UserID)
+	dev := connection.Records.Device(p.UserID)
 	if dev != nil {
-		p.appbar.Title = dev.Name
+		p.appbar.Title = dev.Title()
 	}
 
 	for len(p.items) < len(History) {
@@ -220,7 +282,7 @@ func (p *History) Layout(th *material.Theme, gtx layout.Context) layout.Dimensio
 					return p.items[index].Layout(th, gtx, p.win, p.conf, element.In, func(gtx layout.Context) layout.Dimensions {
 						if element.File != nil {
 							return p.renderFile(th, gtx, element, &item.clickable, func() {
-								element.File.Canceled = true
+								connection.Records.Cancel(element.ID)
 							})
 						}
 						return p.renderMSG(th, gtx, element)
@@ -291,6 +353,168 @@ func (p *History) Layout(th *material.Theme, gtx layout.Context) layout.Dimensio
 	)
 }
 
+func (p *History) deviceName(userID string) string {
+	dev := connection.Records.Device(userID)
+	if dev == nil {
+		return userID
+	}
+	return dev.Title()
+}
+
+// askAlias sets the name the device is shown with, typing its own name
+// drops the alias.
+func (p *History) askAlias(userID string) {
+	dev := connection.Records.Device(userID)
+	if dev == nil {
+		return
+	}
+	text := "Type " + dev.Name + " to use the name of the device"
+	diag := components.NewInputDialog("Rename "+dev.Title(), text, "Alias", nil, func(alias string, ok bool) {
+		if !ok {
+			return
+		}
+		connection.Records.UpdateDevice(userID, func(dev *connection.Device) {
+			dev.Alias = alias
+			if alias == dev.Name {
+				dev.Alias = ""
+			}
+		})
+	})
+	p.conf.OpenDialog(diag.Layout)
+}
+
+// queue adds a dialog to be shown after the ones before it.
+func (p *History) queue(m *modal) {
+	p.dialogs.Lock()
+	p.pending = append(p.pending, m)
+	p.dialogs.Unlock()
+	p.win.Invalidate()
+}
+
+// closed is called by a queued dialog when the user closes it.
+func (p *History) closed(m *modal) {
+	p.dialogs.Lock()
+	if p.shown == m {
+		p.shown = nil
+	}
+	p.dialogs.Unlock()
+	p.win.Invalidate()
+}
+
+// expire drops m, or closes it when it is open.
+func (p *History) expire(m *modal) {
+	if m == nil {
+		return
+	}
+	p.dialogs.Lock()
+	m.expired = true
+	p.dialogs.Unlock()
+	p.win.Invalidate()
+}
+
+// showDialog opens the next queued dialog, it runs on the UI goroutine.
+func (p *History) showDialog() {
+	p.dialogs.Lock()
+	if p.shown != nil && p.shown.expired {
+		p.shown = nil
+		p.dialogs.Unlock()
+		p.conf.CloseDialog()
+		return
+	}
+	var next *modal
+	for p.shown == nil && len(p.pending) > 0 {
+		m := p.pending[0]
+		p.pending = p.pending[1:]
+		if !m.expired {
+			next = m
+			p.shown = m
+		}
+	}
+	p.dialogs.Unlock()
+	if next != nil {
+		p.conf.OpenDialog(next.layout)
+	}
+}
+
+// AskPairCode blocks until the user types the code shown by the peer.
+func (p *History) AskPairCode(userID string) (string, bool) {
+	type answer struct {
+		code string
+		ok   bool
+	}
+	res := make(chan answer, 1)
+	m := &modal{}
+	diag := components.NewPairInputDialog("Pair with "+p.deviceName(userID), func(code string, ok bool) {
+		p.closed(m)
+		res <- answer{code, ok}
+	})
+	m.layout = diag.Layout
+	p.queue(m)
+	a := <-res
+	return a.code, a.ok
+}
+
+func (p *History) ShowPairCode(userID, name, code string) {
+	m := &modal{}
+	diag := components.NewPairDialog("Pairing code for "+name, code, func(string, bool) {
+		p.closed(m)
+	})
+	m.layout = diag.Layout
+	p.dialogs.Lock()
+	p.pairCode = m
+	p.dialogs.Unlock()
+	p.queue(m)
+}
+
+// PairResult replaces the pairing code, if it is still shown.
+func (p *History) PairResult(userID string, e error) {
+	txt := "Paired"
+	if e != nil {
+		txt = e.Error()
+	}
+	p.dialogs.Lock()
+	code := p.pairCode
+	p.pairCode = nil
+	p.dialogs.Unlock()
+	p.expire(code)
+	p.Warn(p.deviceName(userID), txt)
+}
+
+// Warn shows txt until the user closes it.
+func (p *History) Warn(title, txt string) {
+	m := &modal{}
+	diag := components.NewPairDialog(title, txt, func(string, bool) {
+		p.closed(m)
+	})
+	m.layout = diag.Layout
+	p.queue(m)
+}
+
+// AcceptTransfer blocks until the user accepts or rejects the files,
+// they are rejected once ctx is done.
+func (p *History) AcceptTransfer(ctx context.Context, userID, name string, files []*connection.Element, total uint64, delta bool) (string, bool, bool) {
+	type answer struct {
+		dir     string
+		replace bool
+		ok      bool
+	}
+	res := make(chan answer, 1)
+	m := &modal{}
+	diag := components.NewTransferDialog(name, p.conf.Inbox(), files, total, delta, func(dir string, replace, ok bool) {
+		p.closed(m)
+		res <- answer{dir, replace, ok}
+	})
+	m.layout = diag.Layout
+	p.queue(m)
+	select {
+	case a := <-res:
+		return a.dir, a.replace, a.ok
+	case <-ctx.Done():
+		p.expire(m)
+		return "", false, false
+	}
+}
+
 func GetFiles(files []*connection.Element) string {
 	fs := ""
 	for _, f := range files {
@@ -313,13 +537,13 @@ func FormatTime(t time.Time) string {
 }
 
 func (p *History) renderFile(th *material.Theme, gtx layout.Context, element *connection.Transfer, clickable *widget.Clickable, onCancel func()) layout.Dimensions {
-	device := connection.GetDevice(element.UserID)
-	canContinue := device != nil && p.ContinueTrans != nil
+	device := connection.Records.Device(element.UserID)
+	canContinue := device != nil && p.ContinueTrans != nil && !errors.Is(element.Error, connection.ErrDeclined)
 	if clickable.Clicked() {
 		if element.Error == nil && !element.File.Canceled {
-			element.File.Canceled = true
+			connection.Records.Cancel(element.ID)
 		} else if canContinue {
-			go p.ContinueTrans(element.UserID, element)
+			go p.ContinueTrans(element.UserID, element.ID)
 		}
 	}
 	progress := float32(element.File.TransBytes) / float32(element.File.TotalBytes)
@@ -373,6 +597,17 @@ func (p *History) renderFile(th *material.Theme, gtx layout.Context, element *co
 										errLab.Color = p.conf.DangerColor
 										return errLab.Layout(gtx)
 									}
+									if element.File.Hashing {
+										hashed := float32(element.File.Hashed) / float32(element.File.TotalBytes)
+										lab := material.Label(th, th.TextSize, fmt.Sprintf("Preparing files %.0f %%", hashed*100))
+										lab.Color = p.conf.BGPrimaryColor
+										return lab.Layout(gtx)
+									}
+									if element.File.Waiting {
+										lab := material.Label(th, th.TextSize, "Waiting for approval")
+										lab.Color = p.conf.BGPrimaryColor
+										return lab.Layout(gtx)
+									}
 									var txt string
 									if element.File.TransBytes == element.File.TotalBytes {
 										txt = "Completed"
@@ -384,7 +619,12 @@ func (p *History) renderFile(th *material.Theme, gtx layout.Context, element *co
 									return lab.Layout(gtx)
 								}),
 								layout.Rigid(func(gtx layout.Context) layout.Dimensions {
-									lab := material.Label(th, th.TextSize, fmt.Sprintf("%s / %s", formatSize(float64(element.File.TransBytes)), formatSize(float64(element.File.TotalBytes))))
+									txt := fmt.Sprintf("%s / %s", components.FormatSize(float64(element.File.TransBytes)), components.FormatSize(float64(element.File.TotalBytes)))
+									// What compression left of the bytes sent
+									if element.File.Raw > 0 && element.File.Wire < element.File.Raw {
+										txt += fmt.Sprintf(" (%.0f %% on the wire)", float64(element.File.Wire)*100/float64(element.File.Raw))
+									}
+									lab := material.Label(th, th.TextSize, txt)
 									lab.Color = p.conf.BGPrimaryColor
 									return lab.Layout(gtx)
 								}),
@@ -1,10 +1,13 @@
 package screen
 
 import (
+	"context"
 	"fmt"
 	"image"
 	"image/color"
+	"log"
 	"net/netip"
+	"sync"
 	"time"
 
 	"gioui.org/app"
@@ -34,12 +37,21 @@ type Scanner struct {
 	conf     *config.Config
 	src      SNSource
 	scan     widget.Clickable
+	sweep    widget.Clickable
+	add      widget.Clickable
 	list     widget.List
 	devices  []*found
 	anim     outlay.Animation
 	progress float64
 	win      *app.Window
 
+	subnetsMu sync.Mutex
+	subnets   []connection.SubnetProgress
+
+	// What the devices added by hand answered, shown from Layout
+	addedMu sync.Mutex
+	added   []string
+
 	loading_anim_show outlay.Animation
 	loading_anim      *components.LoadingAnim
 	loading_visible   bool
@@ -53,11 +65,17 @@ type Scanner struct {
 	layoutV layout.Flex
 
 	OnOpen func(string)
+	// Probe asks the devices to announce themselves, without it the
+	// scan button sweeps the subnets over TCP.
+	Probe func() error
+	// AddDevice probes an IP or hostname discovery can't reach.
+	AddDevice func(string) (*connection.Device, error)
 }
 
 type found struct {
-	open widget.Clickable
-	Anim outlay.Animation
+	open     widget.Clickable
+	favorite widget.Clickable
+	Anim     outlay.Animation
 }
 
 func NewScannerScreen(th *material.Theme, conf *config.Config, src SNSource, w *app.Window) *Scanner {
@@ -85,8 +103,8 @@ func NewScannerScreen(th *material.Theme, conf *config.Config, src SNSource, w *
 			bls := material.ButtonLayout(th, &sn.scan)
 			bls.CornerRadius = ScreenBarHeight / 2
 			return bls.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
-				if sn.scanner.Running {
-					c := material.ProgressCircle(th, float32(sn.progress))
+				if sn.scanner.Running() {
+					c := material.ProgressCircle(th, sn.scanProgress())
 					c.Color = conf.FGPrimaryColor
 					return layout.Stack{
 						Alignment: layout.Center,
@@ -113,7 +131,13 @@ func NewScannerScreen(th *material.Theme, conf *config.Config, src SNSource, w *
 				return components.NewIcon(th, gtx, config.ICUpdate, conf.FGPrimaryColor, ScreenBarHeight)
 			})
 		},
-	}}, []component.OverflowAction{})
+	}}, []component.OverflowAction{{
+		Name: "TCP sweep",
+		Tag:  &sn.sweep,
+	}, {
+		Name: "Add device",
+		Tag:  &sn.add,
+	}})
 	sn.appbar = appbar
 
 	sn.layoutH.Alignment = layout.Middle
@@ -121,44 +145,46 @@ func NewScannerScreen(th *material.Theme, conf *config.Config, src SNSource, w *
 	sn.layoutV.Axis = layout.Vertical
 
 	sn.list.List.Axis = layout.Vertical
-	sn.scanner.Found = sn.OnFound
+	connection.Records.Subscribe(sn.OnEvent)
 	sn.scanner.Progress = sn.OnProgress
 
 	return sn
 }
 
 func (p *Scanner) Layout(th *material.Theme, gtx layout.Context, w *app.Window, conf *config.Config) layout.Dimensions {
+	p.addedMu.Lock()
+	if len(p.added) > 0 {
+		txt := p.added[0]
+		p.added = p.added[1:]
+		p.conf.OpenDialog(components.NewPairDialog("Add device", txt, nil).Layout)
+	}
+	p.addedMu.Unlock()
 	for _, e := range p.appbar.Events(gtx) {
 		t, ok := e.(component.AppBarOverflowActionClicked)
 		if ok && t.Tag == &p.scan {
-			if p.scanner.Running {
-				p.scanner.Stop()
-			} else {
-				connection.InvalidateDevices()
-				go p.scanner.ScannAll(p.src.GetSubnets())
-			}
+			p.refresh()
+		}
+		if ok && t.Tag == &p.sweep {
+			p.toggleScan()
+		}
+		if ok && t.Tag == &p.add {
+			p.addDevice()
 		}
 	}
 	if p.scan.Clicked() {
-		if p.scanner.Running {
-			p.scanner.Stop()
-		} else {
-			p.loading_anim.Reset()
-			connection.InvalidateDevices()
-			go p.scanner.ScannAll(p.src.GetSubnets())
-		}
+		p.refresh()
 	}
 
-	if p.scanner.Running && !p.loading_ctl {
+	if p.scanner.Running() && !p.loading_ctl {
 		p.loading_anim_show.Start(gtx.Now)
 		p.loading_anim_show.Duration = p.conf.AnimTime()
 		p.loading_visible = true
 		p.loading_ctl = true
-	} else if !p.scanner.Running && p.loading_ctl {
+	} else if !p.scanner.Running() && p.loading_ctl {
 		p.loading_ctl = false
 		p.loading_anim_show.Start(gtx.Now)
 		p.loading_anim_show.Duration = p.conf.AnimTime()
-	} else if !p.scanner.Running && !p.loading_ctl && !p.loading_anim_show.Animating(gtx) {
+	} else if !p.scanner.Running() && !p.loading_ctl && !p.loading_anim_show.Animating(gtx) {
 		p.loading_visible = false
 	}
 
@@ -177,6 +203,14 @@ func (p *Scanner) Layout(th *material.Theme, gtx layout.Context, w *app.Window,
 
 	p.card.Color = conf.BGColor
 
+	devices := connection.Records.Favorites()
+	for len(p.devices) < len(devices) {
+		p.devices = append(p.devices, &found{})
+	}
+	for len(p.devices) > len(devices) {
+		p.devices = p.devices[:len(p.devices)-1]
+	}
+
 	d := p.layoutV.Layout(
 		gtx,
 		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
@@ -191,9 +225,12 @@ func (p *Scanner) Layout(th *material.Theme, gtx layout.Context, w *app.Window,
 				}.Layout(
 					gtx,
 					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
-						probar := material.ProgressBar(th, float32(p.progress))
+						probar := material.ProgressBar(th, p.scanProgress())
 						return probar.Layout(gtx)
 					}),
+					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+						return material.Label(th, th.TextSize*0.6, p.subnetProgress()).Layout(gtx)
+					}),
 					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
 						return layout.UniformInset(3).Layout(gtx, func(gtx layout.Context) layout.Dimensions {
 							return p.loading_anim.Layout(gtx)
@@ -212,9 +249,9 @@ func (p *Scanner) Layout(th *material.Theme, gtx layout.Context, w *app.Window,
 		layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
 			return material.List(th, &p.list).Layout(
 				gtx,
-				len(connection.Devices),
+				len(devices),
 				func(gtx layout.Context, index int) layout.Dimensions {
-					return p.render(th, gtx, w, conf, index)
+					return p.render(th, gtx, w, conf, p.devices[index], devices[index])
 				},
 			)
 		}),
@@ -223,7 +260,7 @@ func (p *Scanner) Layout(th *material.Theme, gtx layout.Context, w *app.Window,
 	return d
 }
 
-func (p *Scanner) render(th *material.Theme, gtx layout.Context, w *app.Window, conf *config.Config, index int) layout.Dimensions {
+func (p *Scanner) render(th *material.Theme, gtx layout.Context, w *app.Window, conf *config.Config, device *found, connDev *connection.Device) layout.Dimensions {
 	const (
 		// In sp
 		title_size = 25
@@ -234,17 +271,30 @@ func (p *Scanner) render(th *material.Theme, gtx layout.Context, w *app.Window,
 		ext_space     = 20
 	)
 
-	for len(p.devices) < len(connection.Devices) {
-		p.devices = append(p.devices, &found{})
-	}
-	for len(p.devices) > len(connection.Devices) {
-		p.devices = p.devices[:len(p.devices)-1]
-	}
-	device := p.devices[index]
-	connDev := connection.Devices[index]
 	if device.open.Clicked() {
 		p.Open(connDev.ID)
 	}
+	if device.favorite.Clicked() {
+		connection.Records.UpdateDevice(connDev.ID, func(dev *connection.Device) {
+			dev.Favorite = !dev.Favorite
+		})
+	}
+
+	// Known devices that didn't answer the last scan are greyed out.
+	accent := conf.BGPrimaryColor
+	if !connDev.Online {
+		accent = conf.FGColor
+	}
+	info := connDev.OS
+	if connDev.Alias != "" {
+		info = connDev.Name + " - " + info
+	}
+	if connDev.Addr != nil {
+		info += " - " + connDev.Addr.String()
+	}
+	if !connDev.Online && !connDev.LastSeen.IsZero() {
+		info += " - " + connDev.LastSeen.Format("2006/01/02 15:04")
+	}
 
 	animPro := device.Anim.Progress(gtx)
 	if animPro < 1 {
@@ -261,18 +311,27 @@ func (p *Scanner) render(th *material.Theme, gtx layout.Context, w *app.Window,
 					return p.layoutH.Layout(
 						gtx,
 						layout.Rigid(func(gtx layout.Context) layout.Dimensions {
-							return components.NewIcon(th, gtx, p.GetOSIcon(connDev.OS), conf.BGPrimaryColor, 60)
+							return components.NewIcon(th, gtx, p.GetOSIcon(connDev.OS), accent, 60)
 						}),
 						layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
 							return p.layoutV.Layout(
 								gtx,
 								layout.Rigid(func(gtx layout.Context) layout.Dimensions {
-									name := material.Label(th, title_size, connDev.Name)
-									name.Color = conf.BGPrimaryColor
+									name := material.Label(th, title_size, connDev.Title())
+									name.Color = accent
 									name.Font.Weight = text.Bold
 									d := p.layoutH.Layout(
 										gtx,
 										layout.Flexed(1, name.Layout),
+										layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+											ic := config.ICUnfavorite
+											if connDev.Favorite {
+												ic = config.ICFavorite
+											}
+											return material.Clickable(gtx, &device.favorite, func(gtx layout.Context) layout.Dimensions {
+												return components.NewIcon(th, gtx, ic, accent, 30)
+											})
+										}),
 										layout.Rigid(func(gtx layout.Context) layout.Dimensions {
 											if connDev.Not == 0 {
 												return layout.Dimensions{}
@@ -299,7 +358,7 @@ func (p *Scanner) render(th *material.Theme, gtx layout.Context, w *app.Window,
 										Min: image.Pt(0, d.Size.Y),
 										Max: image.Pt(d.Size.X, d.Size.Y+gtx.Dp(2)),
 									}
-									paint.FillShape(gtx.Ops, conf.BGPrimaryColor, rec.Op())
+									paint.FillShape(gtx.Ops, accent, rec.Op())
 									return d
 								}),
 								layout.Rigid(func(gtx layout.Context) layout.Dimensions {
@@ -318,12 +377,20 @@ func (p *Scanner) render(th *material.Theme, gtx layout.Context, w *app.Window,
 													return components.NewIcon(th, gtx, ic, conf.FGColor, 25)
 												}),
 												layout.Rigid(func(gtx layout.Context) layout.Dimensions {
-													return material.Label(th, info_size, connDev.OS+" - "+connDev.Addr.String()).Layout(gtx)
+													return material.Label(th, info_size, info).Layout(gtx)
 												}),
 											)
 										},
 									)
 								}),
+								layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+									if connDev.Warning == "" {
+										return layout.Dimensions{}
+									}
+									warning := material.Label(th, info_size, connDev.Warning)
+									warning.Color = conf.DangerColor
+									return warning.Layout(gtx)
+								}),
 							)
 						}),
 					)
@@ -358,15 +425,123 @@ func (p *Scanner) Stopped(gtx layout.Context) bool {
 	return !p.anim.Animating(gtx)
 }
 
-func (p *Scanner) OnFound() {
-	p.win.Invalidate()
+func (p *Scanner) OnEvent(e connection.Event) {
+	switch e.Kind {
+	case connection.DeviceAdded, connection.DeviceChanged, connection.DevicesInvalidated:
+		p.win.Invalidate()
+	}
+}
+
+// refresh probes for the devices, the TCP sweep is the fallback when
+// the beacon is not available.
+func (p *Scanner) refresh() {
+	if p.scanner.Running() || p.Probe == nil {
+		p.toggleScan()
+		return
+	}
+	connection.Records.InvalidateDevices()
+	e := p.Probe()
+	if e != nil {
+		log.Println(e)
+		p.toggleScan()
+	}
+}
+
+// addDevice asks for an address and probes it.
+func (p *Scanner) addDevice() {
+	if p.AddDevice == nil {
+		return
+	}
+	validator := func(s string) bool {
+		_, _, e := connection.ParsePeer(s)
+		return e == nil
+	}
+	diag := components.NewInputDialog("Add device", "IP or hostname, with an optional port", "Address", validator, func(entry string, ok bool) {
+		if !ok {
+			return
+		}
+		go func() {
+			txt := "Added "
+			dev, e := p.AddDevice(entry)
+			if e != nil {
+				txt = e.Error()
+			} else {
+				txt += dev.Name
+			}
+			p.addedMu.Lock()
+			p.added = append(p.added, txt)
+			p.addedMu.Unlock()
+			p.win.Invalidate()
+		}()
+	})
+	p.conf.OpenDialog(diag.Layout)
 }
 
-func (p *Scanner) OnProgress(pro float64) {
-	p.progress = pro
+func (p *Scanner) toggleScan() {
+	if p.scanner.Running() {
+		go p.scanner.Stop()
+		return
+	}
+	p.loading_anim.Reset()
+	p.subnetsMu.Lock()
+	p.subnets = nil
+	p.progress = 0
+	p.subnetsMu.Unlock()
+	connection.Records.InvalidateDevices()
+	results := p.scanner.ScannAll(context.Background(), p.src.GetSubnets())
+	go func() {
+		for dev := range results {
+			connection.Records.SetDevice(dev)
+		}
+		p.win.Invalidate()
+	}()
+}
+
+func (p *Scanner) OnProgress(pro connection.SubnetProgress) {
+	p.subnetsMu.Lock()
+	defer p.subnetsMu.Unlock()
+	found := false
+	var done, total uint64
+	for i, sn := range p.subnets {
+		if sn.Subnet == pro.Subnet {
+			p.subnets[i] = pro
+			found = true
+		}
+		done += p.subnets[i].Done
+		total += p.subnets[i].Total
+	}
+	if !found {
+		p.subnets = append(p.subnets, pro)
+		done += pro.Done
+		total += pro.Total
+	}
+	p.progress = 0
+	if total > 0 {
+		p.progress = float64(done) / float64(total)
+	}
 	p.win.Invalidate()
 }
 
+func (p *Scanner) scanProgress() float32 {
+	p.subnetsMu.Lock()
+	defer p.subnetsMu.Unlock()
+	return float32(p.progress)
+}
+
+// subnetProgress returns a line per scanned subnet.
+func (p *Scanner) subnetProgress() string {
+	p.subnetsMu.Lock()
+	defer p.subnetsMu.Unlock()
+	lines := ""
+	for _, sn := range p.subnets {
+		if lines != "" {
+			lines += "\n"
+		}
+		lines += fmt.Sprintf("%s  %d / %d", sn.Subnet, sn.Done, sn.Total)
+	}
+	return lines
+}
+
 func (p *Scanner) Open(ID string) {
 	if p.OnOpen != nil {
 		p.OnOpen(ID)
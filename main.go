@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 
@@ -21,6 +24,20 @@ import (
 )
 
 func main() {
+	bench := flag.Uint64("bench", 0, "send this many MiB over the loopback with each data loop, print the throughput and exit")
+	flag.Parse()
+	if *bench > 0 {
+		conf := config.NewConfig(nil)
+		results, err := connection.Benchmark(conf.AppDir(), *bench<<20, conf.BufSize())
+		for _, r := range results {
+			fmt.Println(r)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	os.Setenv("LANG", "en_US.utf8")
 	go func() {
 		th := material.NewTheme(font.JGFonts())
@@ -44,7 +61,14 @@ func main() {
 func run(th *material.Theme, w *app.Window, conf *config.Config) error {
 	th.TextSize = unit.Sp(20)
 
-	server := connection.InitServer(conf)
+	// Canceled when the window closes, it stops every connection
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, err := connection.InitServer(ctx, conf)
+	if err != nil {
+		return err
+	}
 	notifications := map[string][]notify.Notification{}
 
 	history := screen.NewHistoryScreen(th, conf, w)
@@ -54,24 +78,48 @@ func run(th *material.Theme, w *app.Window, conf *config.Config) error {
 
 	scanner_screen.OnOpen = history.Open
 	scanner_screen.Notification = notifications
+	scanner_screen.Probe = server.Probe
+	scanner_screen.AddDevice = func(entry string) (*connection.Device, error) {
+		return server.AddPeer(ctx, entry)
+	}
 
 	history.Notification = notifications
-	history.SendMSG = server.SendMSG
-	history.SendRes = server.SendResources
-	history.SendView = server.SendUserView
-	history.ContinueTrans = server.ContinueTrans
+	history.SendMSG = func(userID, msg string) {
+		server.SendMSG(ctx, userID, msg)
+	}
+	history.SendRes = func(userID string, resources []string) {
+		server.SendResources(ctx, userID, resources, false)
+	}
+	history.SendDelta = func(userID string, resources []string) {
+		server.SendResources(ctx, userID, resources, true)
+	}
+	history.SendView = func(userID string) {
+		server.SendUserView(ctx, userID)
+	}
+	history.ContinueTrans = func(userID, transID string) {
+		server.ContinueTrans(ctx, userID, transID)
+	}
+	history.Pair = func(userID string) {
+		server.Pair(ctx, userID)
+	}
 
-	server.UpdateHistory = history.Update
+	connection.Records.Subscribe(history.OnEvent)
+	server.PairCode = history.AskPairCode
+	server.ShowPairCode = history.ShowPairCode
+	server.PairResult = history.PairResult
+	server.AcceptTransfer = history.AcceptTransfer
+	if server.Warning != nil {
+		history.Warn("Listen address", server.Warning.Error())
+	}
 
 	notifier := notification.InitNotifier()
 	server.Notify = func(UserID, title, txt string) {
 		if history.Visibility() && history.UserID == UserID {
-			go server.SendUserView(UserID)
+			go server.SendUserView(ctx, UserID)
 		} else {
-			dev := connection.GetDevice(UserID)
-			if dev != nil {
+			connection.Records.UpdateDevice(UserID, func(dev *connection.Device) {
 				dev.Not++
-			}
+			})
 			if notifier != nil {
 				n, err := notifier.CreateNotification(title, txt)
 				if err == nil {
@@ -85,6 +133,8 @@ func run(th *material.Theme, w *app.Window, conf *config.Config) error {
 		}
 		w.Invalidate()
 	}
+	// Peers are served once every callback is set
+	go server.ProcessServer()
 
 	tabs := screen.NewTabScreen(conf)
 	tabs.Push("Subnetworks", config.ICSubNetworks, subnet_screen)
@@ -107,6 +157,11 @@ func run(th *material.Theme, w *app.Window, conf *config.Config) error {
 		e := <-w.Events()
 		switch e := e.(type) {
 		case system.DestroyEvent:
+			server.Goodbye()
+			cancel()
+			if connection.Store != nil {
+				connection.Store.Save()
+			}
 			return e.Err
 		case system.FrameEvent:
 			gtx := layout.NewContext(&ops, e)